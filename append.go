@@ -0,0 +1,148 @@
+package certificatetransparency
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// OpenEntriesFile opens, or creates, the entries file with the given name for
+// reading and appending. If the file is empty then header, or
+// NewFileHeader(nil) if header is nil, is written to it; otherwise the file
+// keeps its existing format. If header and the existing header both record a
+// log ID and they differ then the file is left untouched and an error is
+// returned. If the file ends with an incomplete record, because an earlier
+// write was interrupted, then that record is removed. A record that only
+// appears incomplete because its length is damaged, and so is followed by
+// complete records, results in an error and the file is left untouched. The
+// index file is brought up to date and the number of entries is returned. On
+// return the file is positioned at the end, ready for appending.
+func OpenEntriesFile(fileName string, header *FileHeader) (f EntriesFile, count uint64, err error) {
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return EntriesFile{}, 0, err
+	}
+	f = EntriesFile{file}
+
+	if header != nil && len(header.LogID) > 0 {
+		existing, err := f.Header()
+		if err != nil {
+			file.Close()
+			return EntriesFile{}, 0, err
+		}
+		if len(existing.LogID) > 0 && !bytes.Equal(existing.LogID, header.LogID) {
+			file.Close()
+			return EntriesFile{}, 0, fmt.Errorf("certificatetransparency: %s is for a different log (%s)", fileName, existing.LogURL)
+		}
+	}
+	if err := f.writeHeaderIfEmpty(header); err != nil {
+		file.Close()
+		return EntriesFile{}, 0, err
+	}
+	if count, err = f.updateIndex(true); err != nil {
+		file.Close()
+		return EntriesFile{}, 0, err
+	}
+	return f, count, nil
+}
+
+// writeHeaderIfEmpty writes header, or NewFileHeader(nil) if header is nil,
+// to f if f is empty.
+func (f EntriesFile) writeHeaderIfEmpty(header *FileHeader) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > 0 {
+		return nil
+	}
+
+	if header == nil {
+		header = NewFileHeader(nil)
+	}
+	encoded, err := header.marshal()
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(encoded, 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// An EntriesAppender buffers entries that are appended to an entries file.
+// DownloadRange calls Sync at the end of each batch, which writes the buffered
+// records and flushes them to stable storage, so a crash loses at most the
+// batch in progress. Any incomplete record that it leaves is removed by
+// OpenEntriesFile.
+type EntriesAppender struct {
+	f      EntriesFile
+	header *FileHeader
+	codec  Codec
+	buf    *bufio.Writer
+	record []byte
+}
+
+// NewAppender returns an EntriesAppender that appends to f in the format
+// given by its header.
+func (f EntriesFile) NewAppender() (*EntriesAppender, error) {
+	header, err := f.Header()
+	if err != nil {
+		return nil, err
+	}
+	codec, err := header.EntryCodec()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, 2); err != nil {
+		return nil, err
+	}
+	return &EntriesAppender{
+		f:      f,
+		header: header,
+		codec:  codec,
+		buf:    bufio.NewWriterSize(f.File, 1<<20),
+	}, nil
+}
+
+// Append buffers a record containing ent to be appended to the file.
+func (a *EntriesAppender) Append(ent *RawEntry) error {
+	z, err := a.codec.Compress(ent.encode())
+	if err != nil {
+		return err
+	}
+	return a.appendCompressed(z)
+}
+
+// appendCompressed buffers a record containing the compressed entry z.
+func (a *EntriesAppender) appendCompressed(z []byte) error {
+	a.record = a.header.appendRecord(a.record[:0], z)
+	_, err := a.buf.Write(a.record)
+	return err
+}
+
+// Write buffers p, which must contain complete records in the file's format,
+// to be appended to the file. Use Append to add entries.
+func (a *EntriesAppender) Write(p []byte) (int, error) {
+	return a.buf.Write(p)
+}
+
+// Sync writes any buffered records to the file and waits for them to reach
+// stable storage.
+func (a *EntriesAppender) Sync() error {
+	if err := a.buf.Flush(); err != nil {
+		return err
+	}
+	return a.f.Sync()
+}
+
+// writeEntry writes ent to out, which is an *EntriesAppender or else receives
+// a record in the format of files without a header.
+func writeEntry(out io.Writer, ent *RawEntry) error {
+	if a, ok := out.(*EntriesAppender); ok {
+		return a.Append(ent)
+	}
+	return ent.writeTo(out)
+}
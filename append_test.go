@@ -0,0 +1,168 @@
+package certificatetransparency
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenEntriesFileOtherLog(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "entries")
+	header := NewFileHeader(nil)
+	header.LogURL = "https://a.example/"
+	header.LogID = bytes.Repeat([]byte{1}, 32)
+	f, _, err := OpenEntriesFile(fileName, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := f.NewAppender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Append(&RawEntry{LeafInput: []byte{1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// Leave an incomplete record, which would be removed if the file were
+	// opened for the right log.
+	if _, err := f.Write([]byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	before, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := NewFileHeader(nil)
+	other.LogID = bytes.Repeat([]byte{2}, 32)
+	if f, _, err := OpenEntriesFile(fileName, other); err == nil {
+		f.Close()
+		t.Fatal("opened an entries file for a different log")
+	}
+	after, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("entries file was modified")
+	}
+}
+
+// writeTestEntries creates an entries file with the given name holding count
+// entries, and returns the offset of each record. If header is nil then the
+// file has no header.
+func writeTestEntries(t *testing.T, fileName string, header *FileHeader, count int) []int64 {
+	file, err := os.Create(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := EntriesFile{file}
+	defer f.Close()
+	var out io.Writer = file
+	var a *EntriesAppender
+	if header != nil {
+		if err := f.writeHeaderIfEmpty(header); err != nil {
+			t.Fatal(err)
+		}
+		if a, err = f.NewAppender(); err != nil {
+			t.Fatal(err)
+		}
+		out = a
+	}
+	for i := 0; i < count; i++ {
+		if err := writeEntry(out, &RawEntry{LeafInput: testLeaf(uint64(i)), ExtraData: []byte{0, 0, 0}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a != nil {
+		if err := a.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return testEntryOffsets(t, f)
+}
+
+// testEntryOffsets returns the offsets of the records in f.
+func testEntryOffsets(t *testing.T, f EntriesFile) []int64 {
+	h, err := f.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := f.newRecordReader(h, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offsets []int64
+	for {
+		ent, err := r.next(true)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, ent.Offset)
+	}
+	return offsets
+}
+
+func TestOpenEntriesFileRepairsTornTail(t *testing.T) {
+	for _, header := range []*FileHeader{NewFileHeader(nil), nil} {
+		fileName := filepath.Join(t.TempDir(), "entries")
+		offsets := writeTestEntries(t, fileName, header, 20)
+		if err := os.Truncate(fileName, offsets[19]+5); err != nil {
+			t.Fatal(err)
+		}
+
+		f, count, err := OpenEntriesFile(fileName, nil)
+		if err != nil {
+			t.Fatalf("header %v: %s", header != nil, err)
+		}
+		info, err := f.Stat()
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 19 || info.Size() != offsets[19] {
+			t.Errorf("header %v: after repair there are %d entries and %d bytes, want 19 and %d", header != nil, count, info.Size(), offsets[19])
+		}
+	}
+}
+
+func TestOpenEntriesFileDamagedLength(t *testing.T) {
+	for _, header := range []*FileHeader{NewFileHeader(nil), nil} {
+		fileName := filepath.Join(t.TempDir(), "entries")
+		offsets := writeTestEntries(t, fileName, header, 20)
+
+		// Damage the length of a record in the middle so that it
+		// appears to extend past the end of the file.
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		length := binary.LittleEndian.Uint32(data[offsets[10]:])
+		binary.LittleEndian.PutUint32(data[offsets[10]:], length|1<<16)
+		if err := ioutil.WriteFile(fileName, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		if f, _, err := OpenEntriesFile(fileName, nil); err == nil {
+			f.Close()
+			t.Fatalf("header %v: opened an entries file with a damaged record", header != nil)
+		}
+		after, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, after) {
+			t.Errorf("header %v: entries file was modified", header != nil)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package certificatetransparency
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Each entry in an entries file is stored as its leaf_input and extra_data,
+// each preceded by a uint32 length, and compressed by the codec named in the
+// file's header. Entries are compressed separately so that any one of them
+// can be read on its own.
+
+const (
+	// CodecNone is the value of FileHeader.Codec when entries are stored
+	// uncompressed.
+	CodecNone = "none"
+	// CodecZstd is the value of FileHeader.Codec when each entry is a
+	// zstd frame compressed with the dictionary in FileHeader.Dictionary.
+	CodecZstd = "zstd"
+)
+
+// maxEntrySize is the largest uncompressed entry that a codec will return.
+const maxEntrySize = 1 << 24
+
+// maxDictionarySize is the largest dictionary that NewZstdDictionary will
+// build.
+const maxDictionarySize = 1 << 17
+
+// A Codec compresses the entries stored in an entries file. Codecs are safe
+// for concurrent use.
+type Codec interface {
+	// Name returns the value of FileHeader.Codec for files that use the
+	// codec.
+	Name() string
+	// Compress returns the compressed form of data.
+	Compress(data []byte) ([]byte, error)
+	// Decompress returns the data that z is the compressed form of.
+	Decompress(z []byte) ([]byte, error)
+}
+
+// EntryCodec returns the codec used for the entries of a file with header h.
+func (h *FileHeader) EntryCodec() (Codec, error) {
+	switch h.Codec {
+	case CodecFlate:
+		return flateCodec{}, nil
+	case CodecNone:
+		return noneCodec{}, nil
+	case CodecZstd:
+		if len(h.Dictionary) == 0 {
+			return nil, errors.New("certificatetransparency: zstd entries file header has no dictionary")
+		}
+		return zstdCodecFor(h.Dictionary)
+	}
+	return nil, fmt.Errorf("certificatetransparency: unknown codec %q in entries file header", h.Codec)
+}
+
+// flateCodec compresses each entry as a deflate stream. It is the codec of
+// files without a header.
+type flateCodec struct{}
+
+func (flateCodec) Name() string { return CodecFlate }
+
+func (flateCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	z, err := flate.NewWriter(&buf, 8)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := z.Write(data); err != nil {
+		return nil, err
+	}
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCodec) Decompress(z []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(z))
+	defer r.Close()
+	data, err := io.ReadAll(io.LimitReader(r, maxEntrySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxEntrySize {
+		return nil, errors.New("certificatetransparency: entry too large")
+	}
+	return data, nil
+}
+
+// noneCodec stores entries uncompressed.
+type noneCodec struct{}
+
+func (noneCodec) Name() string                         { return CodecNone }
+func (noneCodec) Compress(data []byte) ([]byte, error) { return data, nil }
+func (noneCodec) Decompress(z []byte) ([]byte, error) {
+	if len(z) > maxEntrySize {
+		return nil, errors.New("certificatetransparency: entry too large")
+	}
+	return z, nil
+}
+
+// zstdCodec compresses each entry as a zstd frame using a dictionary, which
+// holds the certificates that are common to many entries.
+type zstdCodec struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+// maxCachedZstdCodecs is the number of dictionaries whose codecs are cached.
+// A process typically works with the files of a few logs at once.
+const maxCachedZstdCodecs = 8
+
+// zstdCodecs caches a zstdCodec for each recently used dictionary, keyed by
+// its SHA-256 hash, since they are costly to create. order lists the keys
+// from least to most recently used.
+var zstdCodecs struct {
+	sync.Mutex
+	m     map[[32]byte]*zstdCodec
+	order [][32]byte
+}
+
+// zstdCodecFor returns a zstdCodec that uses dict.
+func zstdCodecFor(dict []byte) (*zstdCodec, error) {
+	key := sha256.Sum256(dict)
+	zstdCodecs.Lock()
+	defer zstdCodecs.Unlock()
+	if c, ok := zstdCodecs.m[key]; ok {
+		for i, k := range zstdCodecs.order {
+			if k == key {
+				zstdCodecs.order = append(append(zstdCodecs.order[:i:i], zstdCodecs.order[i+1:]...), key)
+				break
+			}
+		}
+		return c, nil
+	}
+
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderDict(dict), zstd.WithEncoderCRC(false))
+	if err != nil {
+		return nil, err
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderDicts(dict), zstd.WithDecoderMaxMemory(maxEntrySize), zstd.WithDecoderConcurrency(0))
+	if err != nil {
+		enc.Close()
+		return nil, err
+	}
+	c := &zstdCodec{enc, dec}
+	if zstdCodecs.m == nil {
+		zstdCodecs.m = make(map[[32]byte]*zstdCodec)
+	}
+	if len(zstdCodecs.order) == maxCachedZstdCodecs {
+		// The evicted codec may still be in use, so it isn't closed;
+		// it is freed once no file refers to it.
+		delete(zstdCodecs.m, zstdCodecs.order[0])
+		zstdCodecs.order = zstdCodecs.order[1:]
+	}
+	zstdCodecs.m[key] = c
+	zstdCodecs.order = append(zstdCodecs.order, key)
+	return c, nil
+}
+
+func (c *zstdCodec) Name() string { return CodecZstd }
+
+func (c *zstdCodec) Compress(data []byte) ([]byte, error) {
+	return c.enc.EncodeAll(data, nil), nil
+}
+
+func (c *zstdCodec) Decompress(z []byte) ([]byte, error) {
+	return c.dec.DecodeAll(z, nil)
+}
+
+// NewZstdDictionary builds a dictionary for CodecZstd from a sample of
+// entries. The dictionary's content is the issuing certificates that appear
+// in more than one sample, most common last, preceded by leaf certificates
+// from the samples so that their common structure is also matched.
+func NewZstdDictionary(samples []RawEntry) ([]byte, error) {
+	if len(samples) == 0 {
+		return nil, errors.New("certificatetransparency: no samples for dictionary")
+	}
+
+	type chainCert struct {
+		cert  []byte
+		count int
+	}
+	chainCerts := make(map[[32]byte]*chainCert)
+	var leaves [][]byte
+	contents := make([][]byte, 0, len(samples))
+	for _, sample := range samples {
+		ent, err := parseEntry(sample.LeafInput, sample.ExtraData)
+		if err != nil {
+			return nil, err
+		}
+		contents = append(contents, sample.encode())
+
+		chain := ent.ExtraCerts
+		switch ent.Type {
+		case X509Entry:
+			leaves = append(leaves, ent.X509Cert)
+		case PreCertEntry:
+			if len(chain) > 0 {
+				leaves = append(leaves, chain[0])
+				chain = chain[1:]
+			}
+		}
+		for _, cert := range chain {
+			key := sha256.Sum256(cert)
+			if c, ok := chainCerts[key]; ok {
+				c.count++
+			} else {
+				chainCerts[key] = &chainCert{cert, 1}
+			}
+		}
+	}
+
+	var common []*chainCert
+	for _, c := range chainCerts {
+		if c.count > 1 {
+			common = append(common, c)
+		}
+	}
+	sort.Slice(common, func(i, j int) bool {
+		if common[i].count != common[j].count {
+			return common[i].count > common[j].count
+		}
+		return bytes.Compare(common[i].cert, common[j].cert) < 0
+	})
+
+	// Take the most common issuers that fit, leaving at least a quarter of
+	// the space for leaf certificates.
+	var issuers []byte
+	for _, c := range common {
+		if len(issuers)+len(c.cert) > maxDictionarySize*3/4 {
+			continue
+		}
+		issuers = append(append([]byte(nil), c.cert...), issuers...)
+	}
+	var history []byte
+	for _, leaf := range leaves {
+		if len(history)+len(leaf)+len(issuers) > maxDictionarySize {
+			break
+		}
+		history = append(history, leaf...)
+	}
+	history = append(history, issuers...)
+
+	// Dictionary IDs below 32768 and above 2^31 are reserved.
+	digest := sha256.Sum256(history)
+	id := 32768 + binary.BigEndian.Uint32(digest[:4])%(1<<31-32768)
+	return zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       id,
+		Contents: contents,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+		Level:    zstd.SpeedDefault,
+	})
+}
+
+// encode returns the uncompressed form of ent that a codec compresses.
+func (ent *RawEntry) encode() []byte {
+	out := make([]byte, 0, 8+len(ent.LeafInput)+len(ent.ExtraData))
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(ent.LeafInput)))
+	out = append(out, ent.LeafInput...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(ent.ExtraData)))
+	return append(out, ent.ExtraData...)
+}
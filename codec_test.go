@@ -0,0 +1,33 @@
+package certificatetransparency
+
+import "testing"
+
+func TestNoneCodecLimit(t *testing.T) {
+	if _, err := (noneCodec{}).Decompress(make([]byte, maxEntrySize)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (noneCodec{}).Decompress(make([]byte, maxEntrySize+1)); err == nil {
+		t.Fatal("oversized entry was accepted")
+	}
+}
+
+func TestZstdCodecCacheBounded(t *testing.T) {
+	for i := 0; i < 2*maxCachedZstdCodecs; i++ {
+		var samples []RawEntry
+		for j := uint64(0); j < 16; j++ {
+			samples = append(samples, RawEntry{LeafInput: testLeaf(uint64(i)<<8 | j)})
+		}
+		dict, err := NewZstdDictionary(samples)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := zstdCodecFor(dict); err != nil {
+			t.Fatal(err)
+		}
+	}
+	zstdCodecs.Lock()
+	defer zstdCodecs.Unlock()
+	if len(zstdCodecs.m) > maxCachedZstdCodecs || len(zstdCodecs.order) != len(zstdCodecs.m) {
+		t.Fatalf("cache holds %d codecs (%d ordered)", len(zstdCodecs.m), len(zstdCodecs.order))
+	}
+}
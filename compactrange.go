@@ -0,0 +1,175 @@
+package certificatetransparency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// A CompactRange summarises the first Size leaves of a Merkle tree as the
+// roots of the perfect subtrees along its right edge. It is enough to compute
+// the tree hash and to extend the tree with further leaves without needing
+// the leaves that are already included.
+type CompactRange struct {
+	// Size contains the number of leaves covered by the range.
+	Size uint64
+	// Hashes contains the roots of the perfect subtrees, largest first.
+	// There is one hash for each bit set in Size.
+	Hashes [][sha256.Size]byte
+}
+
+// Append extends r with a leaf with the given leaf hash.
+func (r *CompactRange) Append(leafHash [sha256.Size]byte) {
+	r.Hashes = append(r.Hashes, leafHash)
+	for size := r.Size; size&1 == 1; size >>= 1 {
+		n := len(r.Hashes)
+		var merged [sha256.Size]byte
+		copy(merged[:], hashChildren(r.Hashes[n-2][:], r.Hashes[n-1][:]))
+		r.Hashes = append(r.Hashes[:n-2], merged)
+	}
+	r.Size++
+}
+
+// Root returns the tree hash of the first r.Size leaves.
+func (r *CompactRange) Root() (output [sha256.Size]byte) {
+	if len(r.Hashes) == 0 {
+		return sha256.Sum256(nil)
+	}
+
+	output = r.Hashes[len(r.Hashes)-1]
+	for i := len(r.Hashes) - 2; i >= 0; i-- {
+		copy(output[:], hashChildren(r.Hashes[i][:], output[:]))
+	}
+	return
+}
+
+// ReadCompactRange reads a compact range from fileName, as written by
+// WriteFile. If the file doesn't exist then an empty range is returned.
+func ReadCompactRange(fileName string) (*CompactRange, error) {
+	in, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return new(CompactRange), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	r := new(CompactRange)
+	if err := binary.Read(in, binary.LittleEndian, &r.Size); err != nil {
+		return nil, err
+	}
+
+	numHashes := 0
+	for size := r.Size; size > 0; size >>= 1 {
+		if size&1 == 1 {
+			numHashes++
+		}
+	}
+	r.Hashes = make([][sha256.Size]byte, numHashes)
+	for i := range r.Hashes {
+		if _, err := io.ReadFull(in, r.Hashes[i][:]); err != nil {
+			return nil, err
+		}
+	}
+
+	var trailing [1]byte
+	if n, _ := in.Read(trailing[:]); n != 0 {
+		return nil, errors.New("certificatetransparency: trailing data in compact range file")
+	}
+
+	return r, nil
+}
+
+// WriteFile atomically and durably replaces the contents of fileName with r.
+func (r *CompactRange) WriteFile(fileName string) error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, r.Size)
+	for _, h := range r.Hashes {
+		buf.Write(h[:])
+	}
+
+	tmpName := fileName + ".tmp"
+	out, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(buf.Bytes()); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, fileName); err != nil {
+		return err
+	}
+	return syncDir(fileName)
+}
+
+// CompactRangeFileName returns the name of the file that holds the compact
+// range for the entries file with the given name.
+func CompactRangeFileName(entriesFileName string) string {
+	return entriesFileName + ".range"
+}
+
+// ExtendRange reads entries from f, skipping the first r.Size of them, and
+// appends the remaining entries to r until it covers upTo leaves. The index
+// file, if up to date, is used to find the first entry needed; otherwise the
+// file is read from the start. If status is non-nil then periodic status
+// updates will be written to it and it will be closed on return.
+func (f EntriesFile) ExtendRange(status chan<- OperationStatus, r *CompactRange, upTo uint64) error {
+	if status != nil {
+		defer close(status)
+	}
+
+	if r.Size > upTo {
+		return errors.New("certificatetransparency: compact range is larger than the requested tree")
+	}
+
+	if err := f.SeekEntry(r.Size); err != nil {
+		return err
+	}
+	h, err := f.Header()
+	if err != nil {
+		return err
+	}
+	offset, err := f.Seek(0, 1)
+	if err != nil {
+		return err
+	}
+	records, err := f.newRecordReader(h, offset, r.Size)
+	if err != nil {
+		return err
+	}
+
+	start := r.Size
+	for r.Size < upTo {
+		if status != nil && (r.Size-start)%1000 == 0 {
+			status <- OperationStatus{start, r.Size, upTo}
+		}
+
+		ent, err := records.next(false)
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		leafInput, _, err := ent.decompress()
+		if err != nil {
+			return err
+		}
+
+		r.Append(LeafHash(leafInput))
+	}
+
+	return nil
+}
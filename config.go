@@ -0,0 +1,177 @@
+package certificatetransparency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// LogConfig contains per-log settings. It is kept as JSON in a file next to
+// the log's entries file so that it can be edited by hand.
+type LogConfig struct {
+	TLS TLSConfig `json:"tls"`
+	// RequestsPerSecond, if positive, limits the rate of requests to the
+	// log.
+	RequestsPerSecond float64 `json:"requests_per_second,omitempty"`
+	// MaxAttempts, if positive, overrides the number of attempts in
+	// DefaultRetryPolicy.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// DownloadWorkers, if positive, sets the number of concurrent
+	// get-entries requests.
+	DownloadWorkers int `json:"download_workers,omitempty"`
+	// BatchSize contains the number of entries that the log returns for
+	// each get-entries request, as learnt by DownloadRange.
+	BatchSize uint64 `json:"batch_size,omitempty"`
+}
+
+// TLSConfig controls how the HTTPS connection to a log is authenticated.
+type TLSConfig struct {
+	// RootsFile, if not empty, names a file of PEM certificates that
+	// replace the system roots when verifying the log's certificate.
+	RootsFile string `json:"roots_file,omitempty"`
+	// PinnedSPKIHashes, if not empty, contains base64 SHA-256 hashes of
+	// SubjectPublicKeyInfos. The log's certificate chain must contain a
+	// certificate with one of these keys.
+	PinnedSPKIHashes []string `json:"pinned_spki_sha256,omitempty"`
+	// Insecure disables verification of the log's certificate. Pins, if
+	// any, are then checked against the leaf certificate that the log
+	// presents, since the rest of an unverified chain proves nothing.
+	Insecure bool `json:"insecure,omitempty"`
+}
+
+// LogConfigFileName returns the name of the file that holds the configuration
+// for the entries file with the given name.
+func LogConfigFileName(entriesFileName string) string {
+	return entriesFileName + ".config"
+}
+
+// ReadLogConfig reads a LogConfig from fileName. If the file doesn't exist
+// then the default configuration is returned.
+func ReadLogConfig(fileName string) (*LogConfig, error) {
+	config := new(LogConfig)
+
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// WriteFile atomically replaces the contents of fileName with config.
+func (config *LogConfig) WriteFile(fileName string) error {
+	data, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	tmpName := fileName + ".tmp"
+	if err := ioutil.WriteFile(tmpName, data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, fileName)
+}
+
+// Apply configures log according to config. Requests are retried according
+// to DefaultRetryPolicy, as modified by config.
+func (config *LogConfig) Apply(log *Log) error {
+	client, err := config.TLS.HTTPClient()
+	if err != nil {
+		return err
+	}
+	log.Client = client
+
+	retry := DefaultRetryPolicy
+	if config.MaxAttempts > 0 {
+		retry.MaxAttempts = config.MaxAttempts
+	}
+	log.Retry = &retry
+	log.RequestsPerSecond = config.RequestsPerSecond
+	log.DownloadWorkers = config.DownloadWorkers
+	log.BatchSize = config.BatchSize
+	return nil
+}
+
+// HTTPClient returns an HTTP client that authenticates servers as configured
+// by config. If config contains no settings then http.DefaultClient is
+// returned.
+func (config *TLSConfig) HTTPClient() (*http.Client, error) {
+	if len(config.RootsFile) == 0 && len(config.PinnedSPKIHashes) == 0 && !config.Insecure {
+		return http.DefaultClient, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.Insecure,
+	}
+
+	if len(config.RootsFile) > 0 {
+		pemBytes, err := ioutil.ReadFile(config.RootsFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pemBytes) {
+			return nil, errors.New("certificatetransparency: no certificates found in " + config.RootsFile)
+		}
+	}
+
+	if len(config.PinnedSPKIHashes) > 0 {
+		var pins [][]byte
+		for _, pin := range config.PinnedSPKIHashes {
+			hash, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil {
+				return nil, err
+			}
+			if len(hash) != sha256.Size {
+				return nil, errors.New("certificatetransparency: pinned SPKI hash has wrong length")
+			}
+			pins = append(pins, hash)
+		}
+
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			var certs []*x509.Certificate
+			if config.Insecure {
+				if len(rawCerts) == 0 {
+					return errors.New("certificatetransparency: server presented no certificate")
+				}
+				leaf, err := x509.ParseCertificate(rawCerts[0])
+				if err != nil {
+					return err
+				}
+				certs = append(certs, leaf)
+			} else {
+				for _, chain := range verifiedChains {
+					certs = append(certs, chain...)
+				}
+			}
+
+			for _, cert := range certs {
+				hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				for _, pin := range pins {
+					if bytes.Equal(hash[:], pin) {
+						return nil
+					}
+				}
+			}
+			return errors.New("certificatetransparency: no pinned key found in server's certificate chain")
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,102 @@
+package certificatetransparency
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTLSConfigPins(t *testing.T) {
+	ca := newTestCA(t)
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	caTemplate := *ca.cert
+	caTemplate.NotBefore, caTemplate.NotAfter = template.NotBefore, template.NotAfter
+	caDER, err := x509.CreateCertificate(rand.Reader, &caTemplate, &caTemplate, &ca.key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, template, caCert, &leafKey.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The server presents the CA's certificate after its own.
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{leafDER, caDER},
+		PrivateKey:  leafKey,
+	}}}
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	rootsFile := filepath.Join(t.TempDir(), "roots.pem")
+	if err := ioutil.WriteFile(rootsFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pin := func(cert *x509.Certificate) string {
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		return base64.StdEncoding.EncodeToString(hash[:])
+	}
+	otherPin := pin(newTestCA(t).cert)
+
+	tests := []struct {
+		name   string
+		config TLSConfig
+		ok     bool
+	}{
+		{"verified, leaf pinned", TLSConfig{RootsFile: rootsFile, PinnedSPKIHashes: []string{pin(leaf)}}, true},
+		{"verified, CA pinned", TLSConfig{RootsFile: rootsFile, PinnedSPKIHashes: []string{pin(caCert)}}, true},
+		{"verified, other key pinned", TLSConfig{RootsFile: rootsFile, PinnedSPKIHashes: []string{otherPin}}, false},
+		{"insecure, leaf pinned", TLSConfig{Insecure: true, PinnedSPKIHashes: []string{otherPin, pin(leaf)}}, true},
+		{"insecure, CA pinned", TLSConfig{Insecure: true, PinnedSPKIHashes: []string{pin(caCert)}}, false},
+		{"insecure, other key pinned", TLSConfig{Insecure: true, PinnedSPKIHashes: []string{otherPin}}, false},
+		{"unknown root", TLSConfig{PinnedSPKIHashes: []string{pin(leaf)}}, false},
+	}
+	for _, test := range tests {
+		client, err := test.config.HTTPClient()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("%s: request succeeded: %t, want %t (%v)", test.name, ok, test.ok, err)
+		}
+	}
+}
@@ -5,24 +5,22 @@
 package certificatetransparency
 
 import (
-	"bytes"
-	"compress/flate"
+	"context"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
-	"crypto/tls"
-	"encoding/asn1"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"regexp"
-	"strings"
 	"io"
 	"io/ioutil"
-	"math/big"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -31,13 +29,50 @@ const (
 	certificateTimestamp = 0
 	treeHash             = 1
 	hashSHA256           = 4
+	sigRSA               = 1
 	sigECDSA             = 3
 )
 
 // Log represents a public log.
 type Log struct {
 	Root string
-	Key  *ecdsa.PublicKey
+	// Key is the log's public key, either an *ecdsa.PublicKey or an
+	// *rsa.PublicKey.
+	Key crypto.PublicKey
+	// Client is used for all requests to the log. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+	// Retry controls how failed requests are retried. If nil, requests
+	// are not retried.
+	Retry *RetryPolicy
+	// RequestsPerSecond, if positive, limits the rate at which requests
+	// are made to the log.
+	RequestsPerSecond float64
+	// DownloadWorkers is the number of get-entries requests that
+	// DownloadRange keeps in flight at once. Values less than one are
+	// treated as one.
+	DownloadWorkers int
+	// BatchSize is the number of entries that the log returns for each
+	// get-entries request. If zero, DownloadRange learns it from the log.
+	BatchSize uint64
+	// TileRoot, if not empty, contains the monitoring prefix of a log that
+	// implements the static CT API. Such logs serve a checkpoint and tiles
+	// rather than the JSON API under Root. See
+	// https://c2sp.org/static-ct-api
+	TileRoot string
+	// Origin contains the name of a tiled log in its checkpoint. If empty,
+	// Root without the scheme is used.
+	Origin string
+	// OID, if not empty, contains the contents of the DER encoded object
+	// identifier that identifies the log in RFC 9162 structures.
+	OID []byte
+
+	id          LogID
+	batchMu     sync.Mutex
+	rateMu      sync.Mutex
+	nextRequest time.Time
+	tilesMu     sync.Mutex
+	tiles       *tileReader
 }
 
 // NewLog creates a new Log given the base URL of a public key and its public
@@ -53,12 +88,35 @@ func NewLog(url, pemPublicKey string) (*Log, error) {
 		return nil, err
 	}
 
-	ecdsaKey, ok := key.(*ecdsa.PublicKey)
-	if !ok {
-		return nil, errors.New("certificatetransparency: only ECDSA keys supported at the current time")
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+	default:
+		return nil, errors.New("certificatetransparency: only ECDSA and RSA keys are supported")
 	}
 
-	return &Log{url, ecdsaKey}, nil
+	return &Log{Root: url, Key: key, id: sha256.Sum256(block.Bytes)}, nil
+}
+
+// LogID identifies a log by the SHA-256 hash of its DER encoded public key.
+// See https://tools.ietf.org/html/rfc6962#section-3.2
+type LogID [sha256.Size]byte
+
+func (id LogID) String() string {
+	return base64.StdEncoding.EncodeToString(id[:])
+}
+
+// ID returns the log's LogID.
+func (log *Log) ID() LogID {
+	if log.id != (LogID{}) {
+		return log.id
+	}
+
+	// The Log wasn't created by NewLog.
+	der, err := x509.MarshalPKIXPublicKey(log.Key)
+	if err != nil {
+		return LogID{}
+	}
+	return sha256.Sum256(der)
 }
 
 const pilotKeyPEM = `
@@ -92,145 +150,132 @@ type SignedTreeHead struct {
 	Timestamp uint64    `json:"timestamp"`
 }
 
-type LogOperator struct {
-	Name	string	`json:"name"`
-	Id	uint64	`json:"id"`
+// client returns the HTTP client to use for requests to the log.
+func (log *Log) client() *http.Client {
+	if log.Client != nil {
+		return log.Client
+	}
+	return http.DefaultClient
 }
 
-type LogData struct {
-	Desc	string	`json:"description"` // "description": "Google 'Pilot' log",
-	Key	string	`json:"key"` // "key": "MFkwEwYHKoZIzj0C....o==",
-	URL	string	`json:"url"` // "url": "ct.googleapis.com/pilot",
-	MMD	uint64	`json:"maximum_merge_delay"`// "maximum_merge_delay": 86400,
-	OperatorId []uint64 `json:"operated_by"` // "operated_by": [0]
-	OperatorName	string
-	PublicLog	*Log
-	SafeFileName	string
+// getJSON fetches path, relative to the log's root, and unmarshals the JSON
+// response body, which may be at most maxLen bytes, into v. Failed requests
+// are retried according to log.Retry.
+func (log *Log) getJSON(ctx context.Context, path string, maxLen int64, v interface{}) error {
+	return log.retry(ctx, func() error {
+		return log.getJSONOnce(ctx, path, maxLen, v)
+	})
 }
 
-type LogList struct {
-	OperatorList	[]LogOperator	`json:"operators"`
-	Logs		[]LogData		`json:"logs"`
-	OperatorMap	map[uint64]string
-}
+// retry calls f until it succeeds or returns an error that isn't a
+// retryableError, waiting between attempts according to log.Retry.
+func (log *Log) retry(ctx context.Context, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		if err := log.waitForRateLimit(ctx); err != nil {
+			return err
+		}
 
-func GetAllLogsList() (*LogList, error) {
-	resp, err := http.Get("https://www.certificate-transparency.org/known-logs/all_logs_list.json?attredirects=0&d=1")
-        if err != nil {
-                return nil, err
-        }
-        defer resp.Body.Close()
-        if resp.StatusCode != 200 {
-                return nil, errors.New("certificatetransparency:GetAllLogsList() error from server")
-        }
-        if resp.ContentLength == 0 {
-                return nil, errors.New("certificatetransparency:GetAllLogsList() body unexpectedly missing")
-        }
-        if resp.ContentLength > 1<<16 {
-                return nil, errors.New("certificatetransparency:GetAllLogsList() body too large")
-        }
-        data, err := ioutil.ReadAll(resp.Body)
-        if err != nil {
-                return nil, err
-        }
-        logs := new(LogList)
-        if err := json.Unmarshal(data, &logs); err != nil {
-                return nil, err
-        }
-
-        const BEGIN = `-----BEGIN PUBLIC KEY-----
-`
-        const END = `
------END PUBLIC KEY-----`
+		err := f()
+		retryable, ok := err.(retryableError)
+		if !ok {
+			return err
+		}
+		if log.Retry == nil || attempt >= log.Retry.MaxAttempts || ctx.Err() != nil {
+			return retryable.err
+		}
 
-	logs.OperatorMap = make(map[uint64]string)
-	for _, operator := range logs.OperatorList {
-		logs.OperatorMap[operator.Id] = operator.Name
-	}
-	SafeNameRe := regexp.MustCompile("[^0-9A-Za-z\\.]") 
-	//for _, log := range logs.Logs {
-	//	log.SafeFileName = SafeNameRe.ReplaceAllString(log.URL, "_") + ".log"
-	//}
-	for i, _ := range logs.Logs {
-	//for i := 0; i < len(logs.Logs); i++ {
-		logs.Logs[i].SafeFileName = SafeNameRe.ReplaceAllString(logs.Logs[i].URL, "_") + ".log"
-		operatorNames := []string{}
-		for _, Id := range logs.Logs[i].OperatorId {
-			operatorNames = append(operatorNames, logs.OperatorMap[Id])
+		delay := log.Retry.backoff(attempt)
+		if serverErr, ok := retryable.err.(*ServerError); ok && serverErr.RetryAfter > delay {
+			delay = serverErr.RetryAfter
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return err
 		}
-		logs.Logs[i].OperatorName = strings.Join(operatorNames, ", ")
-		logPEM := BEGIN + logs.Logs[i].Key + END
-		logs.Logs[i].PublicLog, _ = NewLog("https://" + logs.Logs[i].URL, logPEM)
 	}
-	return logs, nil
 }
 
-// GetSignedTreeHead fetches a signed tree-head and verifies the signature.
-func (log *Log) GetSignedTreeHead() (*SignedTreeHead, error) {
-	// See https://tools.ietf.org/html/draft-laurie-pki-sunlight-09#section-4.3
-	var resp *http.Response
-	var err error
-	if strings.HasPrefix("https://ct.gdca.com.cn", log.Root) ||
-		strings.HasPrefix("https://ctlog.gdca.com.cn", log.Root) ||
-		strings.HasPrefix("https://ct.izenpe.com", log.Root) {
-		// Skip verification of HTTPS certificates for these logs
-		fmt.Printf("certificatetransparency:WARNING: Not verifying HTTPs certificate for any downloads from log %s\n", log.Root)
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify : true},
+// getJSONOnce performs a single attempt of getJSON. Errors that are worth
+// retrying are wrapped in a retryableError.
+func (log *Log) getJSONOnce(ctx context.Context, path string, maxLen int64, v interface{}) error {
+	data, err := log.getOnce(ctx, log.Root+path, maxLen)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		if _, ok := err.(*json.SyntaxError); ok {
+			// Most likely a truncated response.
+			return retryableError{err}
 		}
-		InsecureClient := &http.Client{Transport: tr}
-		resp, err = InsecureClient.Get(log.Root + "/ct/v1/get-sth")
-	} else {
-		resp, err = http.Get(log.Root + "/ct/v1/get-sth")
+		return err
 	}
+	return nil
+}
+
+// getOnce fetches url and returns the response body, which may be at most
+// maxLen bytes. Errors that are worth retrying are wrapped in a
+// retryableError.
+func (log *Log) getOnce(ctx context.Context, url string, maxLen int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
+	resp, err := log.client().Do(req)
+	if err != nil {
+		return nil, retryableError{err}
+	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return nil, errors.New("certificatetransparency: error from server")
+		serverErr := &ServerError{
+			URL:        url,
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+		if serverErr.temporary() {
+			return nil, retryableError{serverErr}
+		}
+		return nil, serverErr
 	}
 	if resp.ContentLength == 0 {
-		return nil, errors.New("certificatetransparency: body unexpectedly missing")
+		return nil, retryableError{errors.New("certificatetransparency: body unexpectedly missing")}
 	}
-	if resp.ContentLength > 1<<16 {
+	if resp.ContentLength > maxLen {
 		return nil, errors.New("certificatetransparency: body too large")
 	}
-	data, err := ioutil.ReadAll(resp.Body)
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxLen+1))
 	if err != nil {
-		return nil, err
+		return nil, retryableError{err}
+	}
+	if int64(len(data)) > maxLen {
+		return nil, errors.New("certificatetransparency: body too large")
+	}
+	return data, nil
+}
+
+// GetSignedTreeHead fetches a signed tree-head and verifies the signature. If
+// log.TileRoot is set then the log's checkpoint is fetched instead.
+func (log *Log) GetSignedTreeHead(ctx context.Context) (*SignedTreeHead, error) {
+	if len(log.TileRoot) > 0 {
+		return log.getCheckpoint(ctx)
 	}
 
+	// See https://tools.ietf.org/html/draft-laurie-pki-sunlight-09#section-4.3
 	head := new(SignedTreeHead)
-	if err := json.Unmarshal(data, &head); err != nil {
+	if err := log.getJSON(ctx, "/ct/v1/get-sth", 1<<16, head); err != nil {
 		return nil, err
 	}
 
-	head.Time = time.Unix(int64(head.Timestamp/1000), int64(head.Timestamp%1000))
-
-	// See https://tools.ietf.org/html/rfc5246#section-4.7
-	if len(head.Signature) < 4 {
-		return nil, errors.New("certificatetransparency: signature truncated")
-	}
-	if head.Signature[0] != hashSHA256 {
-		return nil, errors.New("certificatetransparency: unknown hash function")
-	}
-	if head.Signature[1] != sigECDSA {
-		return nil, errors.New("certificatetransparency: unknown signature algorithm")
-	}
+	head.Time = time.Unix(int64(head.Timestamp/1000), int64(head.Timestamp%1000)*int64(time.Millisecond))
 
-	signatureBytes := head.Signature[4:]
-	var sig struct {
-		R, S *big.Int
+	if err := log.verifySignedTreeHead(head); err != nil {
+		return nil, err
 	}
 
-	if signatureBytes, err = asn1.Unmarshal(signatureBytes, &sig); err != nil {
-		return nil, errors.New("certificatetransparency: failed to parse signature: " + err.Error())
-	}
-	if len(signatureBytes) > 0 {
-		return nil, errors.New("certificatetransparency: trailing garbage after signature")
-	}
+	return head, nil
+}
 
+// verifySignedTreeHead checks the signature on head.
+func (log *Log) verifySignedTreeHead(head *SignedTreeHead) error {
 	// See https://tools.ietf.org/html/draft-laurie-pki-sunlight-09#section-3.5
 	signed := make([]byte, 2+8+8+32)
 	x := signed
@@ -243,15 +288,7 @@ func (log *Log) GetSignedTreeHead() (*SignedTreeHead, error) {
 	x = x[8:]
 	copy(x, head.Hash)
 
-	h := sha256.New()
-	h.Write(signed)
-	digest := h.Sum(nil)
-
-	if !ecdsa.Verify(log.Key, digest, sig.R, sig.S) {
-		return nil, errors.New("certificatetransparency: signature verification failed")
-	}
-
-	return head, nil
+	return verifyDigitallySigned(log.Key, signed, head.Signature)
 }
 
 type LogEntryType uint16
@@ -266,37 +303,15 @@ type RawEntry struct {
 	ExtraData []byte `json:"extra_data"`
 }
 
+// writeTo writes ent to out as a record without a checksum, as found in
+// entries files without a header.
 func (ent *RawEntry) writeTo(out io.Writer) error {
-	var buf bytes.Buffer
-	z, err := flate.NewWriter(&buf, 8)
+	z, err := flateCodec{}.Compress(ent.encode())
 	if err != nil {
 		return err
 	}
-	if err := binary.Write(z, binary.LittleEndian, uint32(len(ent.LeafInput))); err != nil {
-		return err
-	}
-	if _, err := z.Write(ent.LeafInput); err != nil {
-		return err
-	}
-	if err := binary.Write(z, binary.LittleEndian, uint32(len(ent.ExtraData))); err != nil {
-		return err
-	}
-	if _, err := z.Write(ent.ExtraData); err != nil {
-		return err
-	}
-	if err := z.Close(); err != nil {
-		return err
-	}
-
-	bytes := buf.Bytes()
-	if err := binary.Write(out, binary.LittleEndian, uint32(len(bytes))); err != nil {
-		return err
-	}
-	if _, err := out.Write(bytes); err != nil {
-		return err
-	}
-
-	return nil
+	_, err = out.Write(new(FileHeader).appendRecord(nil, z))
+	return err
 }
 
 type entries struct {
@@ -307,45 +322,9 @@ type entries struct {
 // index up to, at most, the end index (which may be included). The log may
 // choose to return fewer than the requested number of log entires and this is
 // not considered an error.
-func (log *Log) GetEntries(start, end uint64) ([]RawEntry, error) {
-	var resp *http.Response
-        var err error
-        if strings.HasPrefix("https://ct.gdca.com.cn", log.Root) ||
-                strings.HasPrefix("https://ctlog.gdca.com.cn", log.Root) ||
-                strings.HasPrefix("https://ct.izenpe.com", log.Root) {
-                // Skip verification of HTTPS certificates for these logs
-		// Not printing warning, should have been printed by GetSignedTreeHead
-                fmt.Printf("certificatetransparency:WARNING: Not verifying HTTPs certificate for log %s", log.Root)
-                tr := &http.Transport{
-                        TLSClientConfig: &tls.Config{InsecureSkipVerify : true},
-                }
-                InsecureClient := &http.Client{Transport: tr}
-                resp, err = InsecureClient.Get(fmt.Sprintf("%s/ct/v1/get-entries?start=%d&end=%d", log.Root, start, end))
-        } else {
-                resp, err = http.Get(fmt.Sprintf("%s/ct/v1/get-entries?start=%d&end=%d", log.Root, start, end))
-        }
-
-	if err != nil {
-		return nil, err
-	}
-
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return nil, errors.New("certificatetransparency: error from server")
-	}
-	if resp.ContentLength == 0 {
-		return nil, errors.New("certificatetransparency: body unexpectedly missing")
-	}
-	if resp.ContentLength > 1<<31 {
-		return nil, errors.New("certificatetransparency: body too large")
-	}
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
+func (log *Log) GetEntries(ctx context.Context, start, end uint64) ([]RawEntry, error) {
 	var ents entries
-	if err := json.Unmarshal(data, &ents); err != nil {
+	if err := log.getJSON(ctx, fmt.Sprintf("/ct/v1/get-entries?start=%d&end=%d", start, end), 1<<31, &ents); err != nil {
 		return nil, err
 	}
 
@@ -372,40 +351,3 @@ func (status OperationStatus) Percentage() float32 {
 	}
 	return done * 100 / total
 }
-
-// DownloadRange downloads log entries from the given starting index till one
-// less than upTo. If status is not nil then status updates will be written to
-// it until the function is complete, when it will be closed. The log entries
-// will be compressed and written to out in a format suitable for using with
-// EntriesFile. It returns the new starting index (i.e.  start + the number of
-// entries downloaded).
-func (log *Log) DownloadRange(out io.Writer, status chan<- OperationStatus, start, upTo uint64) (uint64, error) {
-	if status != nil {
-		defer close(status)
-	}
-
-	done := start
-	for done < upTo {
-		if status != nil {
-			status <- OperationStatus{start, done, upTo}
-		}
-
-		max := done + 2000
-		if max >= upTo {
-			max = upTo - 1
-		}
-		ents, err := log.GetEntries(done, max)
-		if err != nil {
-			return done, err
-		}
-
-		for _, ent := range ents {
-			if err := ent.writeTo(out); err != nil {
-				return done, err
-			}
-			done++
-		}
-	}
-
-	return done, nil
-}
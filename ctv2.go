@@ -0,0 +1,462 @@
+package certificatetransparency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// VersionedTransType identifies the type of a TransItem. See
+// https://tools.ietf.org/html/rfc9162#section-4.5
+type VersionedTransType uint16
+
+const (
+	X509EntryV2         VersionedTransType = 0x0101
+	PrecertEntryV2      VersionedTransType = 0x0102
+	X509SCTV2           VersionedTransType = 0x0103
+	PrecertSCTV2        VersionedTransType = 0x0104
+	SignedTreeHeadV2    VersionedTransType = 0x0105
+	ConsistencyProofV2  VersionedTransType = 0x0106
+	InclusionProofV2    VersionedTransType = 0x0107
+	maxTransItemPayload                    = 1 << 24
+)
+
+// TransItem is the container for all CT v2 data structures.
+type TransItem struct {
+	Type VersionedTransType
+	// Data contains the TLS encoded structure selected by Type.
+	Data []byte
+	// Raw contains the complete TransItem, which is what is hashed to form
+	// a Merkle tree leaf.
+	Raw []byte
+}
+
+// tlsParser reads TLS presentation language values from the front of x. The
+// first failure is recorded in err and makes all later reads fail.
+type tlsParser struct {
+	x   []byte
+	err error
+}
+
+func (p *tlsParser) bytes(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+	if len(p.x) < n {
+		p.err = errors.New("certificatetransparency: truncated v2 structure")
+		return nil
+	}
+	ret := p.x[:n]
+	p.x = p.x[n:]
+	return ret
+}
+
+func (p *tlsParser) uint16() uint16 {
+	if b := p.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (p *tlsParser) uint64() uint64 {
+	if b := p.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+// vector reads a variable length value with a lenBytes long length prefix
+// and checks that its length is between min and max.
+func (p *tlsParser) vector(lenBytes, min, max int) []byte {
+	b := p.bytes(lenBytes)
+	if b == nil {
+		return nil
+	}
+	l := 0
+	for _, v := range b {
+		l = l<<8 | int(v)
+	}
+	if l < min || l > max {
+		p.err = errors.New("certificatetransparency: v2 vector length out of range")
+		return nil
+	}
+	ret := p.bytes(l)
+	if ret == nil {
+		return nil
+	}
+	// Distinguish an empty vector from a failure.
+	return ret[:l:l]
+}
+
+// finish returns the first error, or an error if there is unparsed data.
+func (p *tlsParser) finish() error {
+	if p.err == nil && len(p.x) > 0 {
+		p.err = errors.New("certificatetransparency: trailing data after v2 structure")
+	}
+	return p.err
+}
+
+// ParseTransItem parses a TLS encoded TransItem.
+func ParseTransItem(data []byte) (*TransItem, error) {
+	if len(data) < 2 {
+		return nil, errors.New("certificatetransparency: truncated TransItem")
+	}
+	if len(data)-2 > maxTransItemPayload {
+		return nil, errors.New("certificatetransparency: TransItem too large")
+	}
+	return &TransItem{
+		Type: VersionedTransType(binary.BigEndian.Uint16(data)),
+		Data: data[2:],
+		Raw:  data,
+	}, nil
+}
+
+func (item *TransItem) checkType(want VersionedTransType) error {
+	if item.Type != want {
+		return fmt.Errorf("certificatetransparency: TransItem has type %#04x, want %#04x", uint16(item.Type), uint16(want))
+	}
+	return nil
+}
+
+// TimestampedCertificateEntryDataV2 is the data of an x509_entry_v2 or
+// precert_entry_v2 TransItem. See
+// https://tools.ietf.org/html/rfc9162#section-4.7
+type TimestampedCertificateEntryDataV2 struct {
+	// Timestamp is the raw time value from the log.
+	Timestamp uint64
+	// Time is Timestamp converted to a time.Time
+	Time           time.Time
+	IssuerKeyHash  []byte
+	TBSCertificate []byte
+	SCTExtensions  []byte
+}
+
+// TimestampedEntry parses the data of an x509_entry_v2 or precert_entry_v2
+// TransItem.
+func (item *TransItem) TimestampedEntry() (*TimestampedCertificateEntryDataV2, error) {
+	if item.Type != X509EntryV2 && item.Type != PrecertEntryV2 {
+		return nil, item.checkType(X509EntryV2)
+	}
+
+	p := &tlsParser{x: item.Data}
+	entry := new(TimestampedCertificateEntryDataV2)
+	entry.Timestamp = p.uint64()
+	entry.Time = time.Unix(int64(entry.Timestamp/1000), int64(entry.Timestamp%1000)*int64(time.Millisecond))
+	entry.IssuerKeyHash = p.vector(1, 32, 1<<8-1)
+	entry.TBSCertificate = p.vector(3, 1, 1<<24-1)
+	entry.SCTExtensions = p.vector(2, 0, 1<<16-1)
+	if err := p.finish(); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// SignedTreeHeadDataV2 is the data of a signed_tree_head_v2 TransItem. See
+// https://tools.ietf.org/html/rfc9162#section-4.10
+type SignedTreeHeadDataV2 struct {
+	// LogID contains the contents of the log's DER encoded OID.
+	LogID     []byte
+	Timestamp uint64
+	Time      time.Time
+	Size      uint64
+	Hash      []byte
+	// Extensions contains the raw extensions of the tree head.
+	Extensions []byte
+	Signature  []byte
+
+	// treeHead contains the TLS encoded TreeHeadDataV2, which is what is
+	// signed.
+	treeHead []byte
+}
+
+// SignedTreeHead parses the data of a signed_tree_head_v2 TransItem. The
+// signature is not checked; use Log.VerifySignedTreeHeadV2 for that.
+func (item *TransItem) SignedTreeHead() (*SignedTreeHeadDataV2, error) {
+	if err := item.checkType(SignedTreeHeadV2); err != nil {
+		return nil, err
+	}
+
+	p := &tlsParser{x: item.Data}
+	sth := new(SignedTreeHeadDataV2)
+	sth.LogID = p.vector(1, 2, 127)
+	treeHeadStart := len(item.Data) - len(p.x)
+	sth.Timestamp = p.uint64()
+	sth.Time = time.Unix(int64(sth.Timestamp/1000), int64(sth.Timestamp%1000)*int64(time.Millisecond))
+	sth.Size = p.uint64()
+	sth.Hash = p.vector(1, 32, 1<<8-1)
+	sth.Extensions = p.vector(2, 0, 1<<16-1)
+	if p.err == nil {
+		sth.treeHead = item.Data[treeHeadStart : len(item.Data)-len(p.x)]
+	}
+	sth.Signature = p.vector(2, 1, 1<<16-1)
+	if err := p.finish(); err != nil {
+		return nil, err
+	}
+	return sth, nil
+}
+
+// InclusionProofDataV2 is the data of an inclusion_proof_v2 TransItem. See
+// https://tools.ietf.org/html/rfc9162#section-4.12
+type InclusionProofDataV2 struct {
+	LogID         []byte
+	TreeSize      uint64
+	LeafIndex     uint64
+	InclusionPath [][]byte
+}
+
+// InclusionProof parses the data of an inclusion_proof_v2 TransItem.
+func (item *TransItem) InclusionProof() (*InclusionProofDataV2, error) {
+	if err := item.checkType(InclusionProofV2); err != nil {
+		return nil, err
+	}
+
+	p := &tlsParser{x: item.Data}
+	proof := new(InclusionProofDataV2)
+	proof.LogID = p.vector(1, 2, 127)
+	proof.TreeSize = p.uint64()
+	proof.LeafIndex = p.uint64()
+	proof.InclusionPath = parseNodeHashes(p)
+	if err := p.finish(); err != nil {
+		return nil, err
+	}
+	return proof, nil
+}
+
+// ConsistencyProofDataV2 is the data of a consistency_proof_v2 TransItem. See
+// https://tools.ietf.org/html/rfc9162#section-4.11
+type ConsistencyProofDataV2 struct {
+	LogID           []byte
+	TreeSize1       uint64
+	TreeSize2       uint64
+	ConsistencyPath [][]byte
+}
+
+// ConsistencyProof parses the data of a consistency_proof_v2 TransItem.
+func (item *TransItem) ConsistencyProof() (*ConsistencyProofDataV2, error) {
+	if err := item.checkType(ConsistencyProofV2); err != nil {
+		return nil, err
+	}
+
+	p := &tlsParser{x: item.Data}
+	proof := new(ConsistencyProofDataV2)
+	proof.LogID = p.vector(1, 2, 127)
+	proof.TreeSize1 = p.uint64()
+	proof.TreeSize2 = p.uint64()
+	proof.ConsistencyPath = parseNodeHashes(p)
+	if err := p.finish(); err != nil {
+		return nil, err
+	}
+	return proof, nil
+}
+
+// parseNodeHashes reads a NodeHash path<0..2^16-1>.
+func parseNodeHashes(p *tlsParser) [][]byte {
+	path := &tlsParser{x: p.vector(2, 0, 1<<16-1)}
+	if p.err != nil {
+		return nil
+	}
+	var hashes [][]byte
+	for len(path.x) > 0 && path.err == nil {
+		hashes = append(hashes, path.vector(1, 32, 1<<8-1))
+	}
+	if path.err != nil {
+		p.err = path.err
+	}
+	return hashes
+}
+
+// VerifySignedTreeHeadV2 checks that sth is signed by log. If log.OID is set
+// then the log ID in sth must match it.
+func (log *Log) VerifySignedTreeHeadV2(sth *SignedTreeHeadDataV2) error {
+	if len(log.OID) > 0 && !bytes.Equal(sth.LogID, log.OID) {
+		return errors.New("certificatetransparency: tree head is from a different log")
+	}
+	if sth.treeHead == nil {
+		return errors.New("certificatetransparency: tree head was not parsed from a TransItem")
+	}
+	return verifySignature(log.Key, sth.treeHead, sth.Signature)
+}
+
+// decodeTransItem parses a base64 encoded TransItem from a v2 JSON response.
+func decodeTransItem(b64 string) (*TransItem, error) {
+	data, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTransItem(data)
+}
+
+// getVerifiedSTHV2 parses and verifies the base64 encoded STH TransItem that
+// accompanies v2 responses.
+func (log *Log) getVerifiedSTHV2(b64 string) (*SignedTreeHeadDataV2, error) {
+	item, err := decodeTransItem(b64)
+	if err != nil {
+		return nil, err
+	}
+	sth, err := item.SignedTreeHead()
+	if err != nil {
+		return nil, err
+	}
+	if err := log.VerifySignedTreeHeadV2(sth); err != nil {
+		return nil, err
+	}
+	return sth, nil
+}
+
+// GetSignedTreeHeadV2 fetches a v2 signed tree-head and verifies the
+// signature.
+func (log *Log) GetSignedTreeHeadV2(ctx context.Context) (*SignedTreeHeadDataV2, error) {
+	// See https://tools.ietf.org/html/rfc9162#section-5.2
+	var resp struct {
+		STH string `json:"sth"`
+	}
+	if err := log.getJSON(ctx, "/ct/v2/get-sth", 1<<16, &resp); err != nil {
+		return nil, err
+	}
+	return log.getVerifiedSTHV2(resp.STH)
+}
+
+// GetSTHConsistencyV2 fetches a v2 consistency proof between the trees of
+// sizes first and second, along with the log's current signed tree-head,
+// whose signature is verified.
+func (log *Log) GetSTHConsistencyV2(ctx context.Context, first, second uint64) (*ConsistencyProofDataV2, *SignedTreeHeadDataV2, error) {
+	// See https://tools.ietf.org/html/rfc9162#section-5.3
+	var resp struct {
+		Consistency string `json:"consistency"`
+		STH         string `json:"sth"`
+	}
+	if err := log.getJSON(ctx, fmt.Sprintf("/ct/v2/get-sth-consistency?first=%d&second=%d", first, second), 1<<16, &resp); err != nil {
+		return nil, nil, err
+	}
+
+	item, err := decodeTransItem(resp.Consistency)
+	if err != nil {
+		return nil, nil, err
+	}
+	proof, err := item.ConsistencyProof()
+	if err != nil {
+		return nil, nil, err
+	}
+	sth, err := log.getVerifiedSTHV2(resp.STH)
+	if err != nil {
+		return nil, nil, err
+	}
+	return proof, sth, nil
+}
+
+// GetProofByHashV2 fetches a v2 inclusion proof for the leaf with the given
+// hash in the tree of size treeSize, along with the log's current signed
+// tree-head, whose signature is verified.
+func (log *Log) GetProofByHashV2(ctx context.Context, leafHash []byte, treeSize uint64) (*InclusionProofDataV2, *SignedTreeHeadDataV2, error) {
+	// See https://tools.ietf.org/html/rfc9162#section-5.4
+	if len(leafHash) != sha256.Size {
+		return nil, nil, errors.New("certificatetransparency: leaf hash has wrong length")
+	}
+
+	var resp struct {
+		Inclusion string `json:"inclusion"`
+		STH       string `json:"sth"`
+	}
+	path := fmt.Sprintf("/ct/v2/get-proof-by-hash?hash=%s&tree_size=%d", url.QueryEscape(base64.StdEncoding.EncodeToString(leafHash)), treeSize)
+	if err := log.getJSON(ctx, path, 1<<16, &resp); err != nil {
+		return nil, nil, err
+	}
+
+	item, err := decodeTransItem(resp.Inclusion)
+	if err != nil {
+		return nil, nil, err
+	}
+	proof, err := item.InclusionProof()
+	if err != nil {
+		return nil, nil, err
+	}
+	sth, err := log.getVerifiedSTHV2(resp.STH)
+	if err != nil {
+		return nil, nil, err
+	}
+	return proof, sth, nil
+}
+
+// EntryV2 is a single entry returned by the v2 get-entries endpoint.
+type EntryV2 struct {
+	// LogEntry is an x509_entry_v2 or precert_entry_v2 TransItem. Its Raw
+	// field is the Merkle tree leaf.
+	LogEntry *TransItem
+	// Submission contains the certificate or precertificate that was
+	// submitted to the log.
+	Submission []byte
+	// CertificateChain contains the chain that was submitted with it.
+	CertificateChain [][]byte
+	// SCT is the x509_sct_v2 or precert_sct_v2 TransItem that the log
+	// issued, if it was returned.
+	SCT *TransItem
+}
+
+// GetEntriesV2 returns a series of consecutive log entries using the v2 API.
+// As with GetEntries, the log may return fewer entries than requested.
+func (log *Log) GetEntriesV2(ctx context.Context, start, end uint64) ([]EntryV2, error) {
+	// See https://tools.ietf.org/html/rfc9162#section-5.6
+	var resp struct {
+		Entries []struct {
+			LogEntry       string `json:"log_entry"`
+			SubmittedEntry struct {
+				Submission       []byte   `json:"submission"`
+				CertificateChain [][]byte `json:"certificate_chain"`
+			} `json:"submitted_entry"`
+			SCT string `json:"sct"`
+		} `json:"entries"`
+		STH string `json:"sth"`
+	}
+	if err := log.getJSON(ctx, fmt.Sprintf("/ct/v2/get-entries?start=%d&end=%d", start, end), 1<<31, &resp); err != nil {
+		return nil, err
+	}
+
+	var ents []EntryV2
+	for _, ent := range resp.Entries {
+		logEntry, err := decodeTransItem(ent.LogEntry)
+		if err != nil {
+			return nil, err
+		}
+		if logEntry.Type != X509EntryV2 && logEntry.Type != PrecertEntryV2 {
+			return nil, errors.New("certificatetransparency: v2 log entry has unexpected type")
+		}
+
+		entry := EntryV2{
+			LogEntry:         logEntry,
+			Submission:       ent.SubmittedEntry.Submission,
+			CertificateChain: ent.SubmittedEntry.CertificateChain,
+		}
+		if len(ent.SCT) > 0 {
+			if entry.SCT, err = decodeTransItem(ent.SCT); err != nil {
+				return nil, err
+			}
+		}
+		ents = append(ents, entry)
+	}
+
+	return ents, nil
+}
+
+// VerifyInclusionProofV2 checks that proof shows that the leaf with the
+// given leaf hash is included in the tree described by sth.
+func VerifyInclusionProofV2(leafHash []byte, proof *InclusionProofDataV2, sth *SignedTreeHeadDataV2) error {
+	if proof.TreeSize != sth.Size {
+		return errors.New("certificatetransparency: inclusion proof is for a different tree size")
+	}
+	return verifyAuditPath(leafHash, proof.LeafIndex, sth.Size, proof.InclusionPath, sth.Hash)
+}
+
+// VerifyConsistencyProofV2 checks that proof shows that the tree described by
+// newer is an append-only extension of the tree described by older.
+func VerifyConsistencyProofV2(older, newer *SignedTreeHeadDataV2, proof *ConsistencyProofDataV2) error {
+	if proof.TreeSize1 != older.Size || proof.TreeSize2 != newer.Size {
+		return errors.New("certificatetransparency: consistency proof is for different tree sizes")
+	}
+	return verifyConsistency(older.Size, newer.Size, older.Hash, newer.Hash, proof.ConsistencyPath)
+}
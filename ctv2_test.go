@@ -0,0 +1,175 @@
+package certificatetransparency
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestInclusionProofV2BadHashLength(t *testing.T) {
+	data := []byte{
+		0x01, 0x07, // inclusion_proof_v2
+		2, 0x2b, 0x06, // log_id
+		0, 0, 0, 0, 0, 0, 0, 8, // tree_size
+		0, 0, 0, 0, 0, 0, 0, 1, // leaf_index
+		0, 3, // inclusion_path length
+		5, 0, 0, // a NodeHash that is too short
+	}
+	item, err := ParseTransItem(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := item.InclusionProof()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("malformed inclusion proof was accepted")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("InclusionProof did not return")
+	}
+}
+
+// encodeProofV2 returns a TransItem of the given type, either
+// inclusion_proof_v2 or consistency_proof_v2, whose two uint64 fields are a
+// and b and whose path is path.
+func encodeProofV2(typ VersionedTransType, a, b uint64, path [][]byte) []byte {
+	var hashes []byte
+	for _, h := range path {
+		hashes = append(append(hashes, byte(len(h))), h...)
+	}
+	out := binary.BigEndian.AppendUint16(nil, uint16(typ))
+	out = append(out, 2, 0x2b, 0x06)
+	out = binary.BigEndian.AppendUint64(out, a)
+	out = binary.BigEndian.AppendUint64(out, b)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(hashes)))
+	return append(out, hashes...)
+}
+
+func TestVerifyInclusionProofV2(t *testing.T) {
+	for n := 1; n <= len(referenceLeaves); n++ {
+		sth := &SignedTreeHeadDataV2{Size: uint64(n), Hash: mustDecodeHex(referenceRoots[n-1])}
+		for m := 0; m < n; m++ {
+			leaf := LeafHash(referenceLeaves[m])
+			path := referencePath(m, referenceLeaves[:n])
+
+			tests := []struct {
+				name string
+				data []byte
+				ok   bool
+			}{
+				{"valid", encodeProofV2(InclusionProofV2, uint64(n), uint64(m), path), true},
+				{"wrong tree size", encodeProofV2(InclusionProofV2, uint64(n+1), uint64(m), path), false},
+				{"index beyond tree", encodeProofV2(InclusionProofV2, uint64(n), uint64(n), path), false},
+				{"extra hash", encodeProofV2(InclusionProofV2, uint64(n), uint64(m), append(append([][]byte(nil), path...), sth.Hash)), false},
+			}
+			if len(path) > 0 {
+				tests = append(tests, []struct {
+					name string
+					data []byte
+					ok   bool
+				}{
+					{"missing hash", encodeProofV2(InclusionProofV2, uint64(n), uint64(m), path[:len(path)-1]), false},
+					{"wrong hash", encodeProofV2(InclusionProofV2, uint64(n), uint64(m), withHash(path, 0, flipped(path[0]))), false},
+				}...)
+			}
+			for _, test := range tests {
+				item, err := ParseTransItem(test.data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				proof, err := item.InclusionProof()
+				if err != nil {
+					t.Errorf("leaf %d in tree of size %d: %s: %s", m, n, test.name, err)
+					continue
+				}
+				err = VerifyInclusionProofV2(leaf[:], proof, sth)
+				if test.ok && err != nil {
+					t.Errorf("leaf %d in tree of size %d: %s: %s", m, n, test.name, err)
+				}
+				if !test.ok && err == nil {
+					t.Errorf("leaf %d in tree of size %d: %s was accepted", m, n, test.name)
+				}
+			}
+		}
+	}
+}
+
+func TestVerifyConsistencyProofV2(t *testing.T) {
+	for n := 1; n <= len(referenceLeaves); n++ {
+		newer := &SignedTreeHeadDataV2{Size: uint64(n), Hash: mustDecodeHex(referenceRoots[n-1])}
+		for m := 1; m <= n; m++ {
+			older := &SignedTreeHeadDataV2{Size: uint64(m), Hash: mustDecodeHex(referenceRoots[m-1])}
+			path := referenceProof(m, referenceLeaves[:n])
+
+			tests := []struct {
+				name string
+				data []byte
+				ok   bool
+			}{
+				{"valid", encodeProofV2(ConsistencyProofV2, uint64(m), uint64(n), path), true},
+				{"wrong older size", encodeProofV2(ConsistencyProofV2, uint64(m-1), uint64(n), path), false},
+				{"wrong newer size", encodeProofV2(ConsistencyProofV2, uint64(m), uint64(n+1), path), false},
+				{"extra hash", encodeProofV2(ConsistencyProofV2, uint64(m), uint64(n), append(append([][]byte(nil), path...), newer.Hash)), false},
+			}
+			if len(path) > 0 {
+				tests = append(tests, []struct {
+					name string
+					data []byte
+					ok   bool
+				}{
+					{"missing hash", encodeProofV2(ConsistencyProofV2, uint64(m), uint64(n), path[:len(path)-1]), false},
+					{"wrong hash", encodeProofV2(ConsistencyProofV2, uint64(m), uint64(n), withHash(path, len(path)-1, flipped(path[len(path)-1]))), false},
+				}...)
+			}
+			for _, test := range tests {
+				item, err := ParseTransItem(test.data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				proof, err := item.ConsistencyProof()
+				if err != nil {
+					t.Errorf("trees of sizes %d and %d: %s: %s", m, n, test.name, err)
+					continue
+				}
+				err = VerifyConsistencyProofV2(older, newer, proof)
+				if test.ok && err != nil {
+					t.Errorf("trees of sizes %d and %d: %s: %s", m, n, test.name, err)
+				}
+				if !test.ok && err == nil {
+					t.Errorf("trees of sizes %d and %d: %s was accepted", m, n, test.name)
+				}
+			}
+		}
+	}
+}
+
+func TestParseProofV2Malformed(t *testing.T) {
+	hash := make([]byte, 32)
+	valid := encodeProofV2(InclusionProofV2, 2, 0, [][]byte{hash})
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated", valid[:len(valid)-1]},
+		{"trailing data", append(append([]byte(nil), valid...), 0)},
+		{"short hash", encodeProofV2(InclusionProofV2, 2, 0, [][]byte{hash[:31]})},
+		{"empty hash", encodeProofV2(InclusionProofV2, 2, 0, [][]byte{nil})},
+		{"wrong type", encodeProofV2(ConsistencyProofV2, 2, 0, [][]byte{hash})},
+		{"no log ID", append([]byte{0x01, 0x07, 0}, valid[5:]...)},
+	}
+	for _, test := range tests {
+		item, err := ParseTransItem(test.data)
+		if err != nil {
+			continue
+		}
+		if _, err := item.InclusionProof(); err == nil {
+			t.Errorf("%s: malformed inclusion proof was accepted", test.name)
+		}
+	}
+}
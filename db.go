@@ -2,10 +2,12 @@ package certificatetransparency
 
 import (
 	"bytes"
-	"compress/flate"
 	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash"
 	"io"
 	"os"
@@ -20,58 +22,74 @@ type EntriesFile struct {
 }
 
 // Count returns the number of entries from the current position till the end
-// of the file. On return the file will be positioned at the end.
+// of the file. On return the file will be positioned at the end. An incomplete
+// record at the end of the file results in an *EntryParseError; see
+// OpenEntriesFile for removing one.
 func (f EntriesFile) Count() (count uint64, err error) {
-	for {
-		var zLen uint32
-		if err := binary.Read(f.File, binary.LittleEndian, &zLen); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return 0, err
-		}
+	h, err := f.Header()
+	if err != nil {
+		return 0, err
+	}
+	offset, err := f.Seek(0, 1)
+	if err != nil {
+		return 0, err
+	}
+	r, err := f.newRecordReader(h, offset, 0)
+	if err != nil {
+		return 0, err
+	}
 
-		if _, err = f.Seek(int64(zLen), 1); err != nil {
+	for {
+		if _, err := r.next(true); err == io.EOF {
+			break
+		} else if err != nil {
 			return 0, err
 		}
-
 		count++
 	}
 
+	_, err = f.Seek(r.offset, 0)
 	return
 }
 
-func (f EntriesFile) readEntries(entries chan<- EntryAndPosition) error {
+// errStopped is returned by readEntries when it is told to stop.
+var errStopped = errors.New("certificatetransparency: reading stopped")
+
+// readEntries sends the entries from the current position of f to entries,
+// which it closes on return. It stops early if stop is closed.
+func (f EntriesFile) readEntries(entries chan<- EntryAndPosition, stop <-chan struct{}) error {
 	defer close(entries)
-	var offset int64
 
-	index := uint64(0)
+	h, err := f.Header()
+	if err != nil {
+		return err
+	}
+	offset, err := f.Seek(0, 1)
+	if err != nil {
+		return err
+	}
+	r, err := f.newRecordReader(h, offset, 0)
+	if err != nil {
+		return err
+	}
+
 	for {
-		var zLen uint32
-		if err := binary.Read(f, binary.LittleEndian, &zLen); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
+		ent, err := r.next(false)
+		if err == io.EOF {
+			break
 		}
-
-		data := make([]byte, zLen)
-		if _, err := io.ReadFull(f, data); err != nil {
+		if err != nil {
 			return err
 		}
-
-		entries <- EntryAndPosition{
-			Index:  index,
-			Offset: offset,
-			Length: 4 + int(zLen),
-			Raw:    data,
+		select {
+		case entries <- *ent:
+		case <-stop:
+			return errStopped
 		}
-
-		offset += 4 + int64(zLen)
-		index++
 	}
 
-	return nil
+	_, err = f.Seek(r.offset, 0)
+	return err
 }
 
 func mapWorker(f func(*EntryAndPosition, error), entries <-chan EntryAndPosition, wg *sync.WaitGroup) {
@@ -96,7 +114,7 @@ func (f EntriesFile) Map(mapFunc func(*EntryAndPosition, error)) error {
 		go mapWorker(mapFunc, entries, wg)
 	}
 
-	err := f.readEntries(entries)
+	err := f.readEntries(entries, nil)
 	wg.Wait()
 
 	return err
@@ -104,8 +122,24 @@ func (f EntriesFile) Map(mapFunc func(*EntryAndPosition, error)) error {
 
 type hashWorkersState struct {
 	hashesChan chan [32]byte
-	lastOffset int64
-	cond       *sync.Cond
+	// next contains the index of the next entry to be hashed.
+	next uint64
+	cond *sync.Cond
+	// err contains the first error from a worker. When it is set, stop is
+	// closed and the other workers return.
+	err  error
+	stop chan struct{}
+}
+
+// fail records err, if it is the first error, and stops the workers.
+func (state *hashWorkersState) fail(err error) {
+	state.cond.L.Lock()
+	defer state.cond.L.Unlock()
+	if state.err == nil {
+		state.err = err
+		close(state.stop)
+	}
+	state.cond.Broadcast()
 }
 
 var (
@@ -142,12 +176,11 @@ func hashWorker(state *hashWorkersState, entries <-chan EntryAndPosition, status
 
 	count := uint64(0)
 	for ent := range entries {
-		z := flate.NewReader(bytes.NewBuffer(ent.Raw))
-		leafInput, err := readLengthPrefixed(z)
+		leafInput, _, err := ent.decompress()
 		if err != nil {
-			panic(err)
+			state.fail(err)
+			return
 		}
-		z.Close()
 
 		h.Reset()
 		h.Write(exteriorNodePrefix)
@@ -155,16 +188,20 @@ func hashWorker(state *hashWorkersState, entries <-chan EntryAndPosition, status
 		h.Sum(digest[:0])
 
 		state.cond.L.Lock()
-		for {
-			if state.lastOffset == ent.Offset {
+		for state.err == nil {
+			if state.next == ent.Index {
 				state.hashesChan <- digest
-				state.lastOffset = ent.Offset + int64(ent.Length)
+				state.next++
 				state.cond.Broadcast()
 				break
 			}
 			state.cond.Wait()
 		}
+		stopped := state.err != nil
 		state.cond.L.Unlock()
+		if stopped {
+			return
+		}
 
 		if status != nil && count%divisor == phase {
 			status <- OperationStatus{0, ent.Index, total}
@@ -174,7 +211,9 @@ func hashWorker(state *hashWorkersState, entries <-chan EntryAndPosition, status
 }
 
 // HashTree hashes count log entries from f and returns the tree hash. If
-// status is non-nil then periodic status updates will be written to it.
+// status is non-nil then periodic status updates will be written to it and it
+// will be closed on return. An entry that is corrupt, for example because its
+// checksum doesn't match, results in an *EntryParseError.
 func (f EntriesFile) HashTree(status chan<- OperationStatus, count uint64) (output [sha256.Size]byte, err error) {
 	wg := new(sync.WaitGroup)
 	entries := make(chan EntryAndPosition)
@@ -183,6 +222,7 @@ func (f EntriesFile) HashTree(status chan<- OperationStatus, count uint64) (outp
 	state := &hashWorkersState{
 		hashesChan: make(chan [32]byte, runtime.NumCPU()),
 		cond:       sync.NewCond(mutex),
+		stop:       make(chan struct{}),
 	}
 
 	for i := 0; i < runtime.NumCPU(); i++ {
@@ -191,22 +231,27 @@ func (f EntriesFile) HashTree(status chan<- OperationStatus, count uint64) (outp
 		go hashWorker(state, entries, status, uint64(i)*statusFraction, uint64(runtime.NumCPU())*statusFraction, count, wg)
 	}
 
-	wg.Add(1)
+	hashed := make(chan struct{})
 	go func() {
 		hashTree(&output, sha256.New(), state.hashesChan, count)
-		wg.Done()
+		close(hashed)
 	}()
 
-	if err = f.readEntries(entries); err != nil {
-		return
-	}
+	err = f.readEntries(entries, state.stop)
 	wg.Wait()
+	// All the workers have returned so nothing else will be hashed. Closing
+	// the channel lets hashTree finish if there were fewer than count
+	// entries.
+	close(state.hashesChan)
+	<-hashed
 
 	if status != nil {
 		close(status)
 	}
-
-	return
+	if state.err != nil {
+		return output, state.err
+	}
+	return output, err
 }
 
 // Entry represents a log entry. See
@@ -220,12 +265,70 @@ type Entry struct {
 	X509Cert          []byte
 	PreCertIssuerHash []byte
 	TBSCert           []byte
-	ExtraCerts        [][]byte
+	// RawExtensions contains the CtExtensions from the end of the
+	// TimestampedEntry.
+	RawExtensions []byte
+	// Extensions contains RawExtensions parsed as a list of extensions,
+	// which is how static CT API logs encode them. RFC 6962 leaves the
+	// format to each log, so it is nil if RawExtensions is empty or isn't
+	// such a list.
+	Extensions []CTExtension
+	// ExtraCerts contains the certificates from the entry's extra data.
+	// For a PreCertEntry the first is the precertificate itself and the
+	// remainder are the chain.
+	ExtraCerts [][]byte
 
 	LeafInput []byte
 	ExtraData []byte
 }
 
+// CTExtensionType identifies a CTExtension.
+type CTExtensionType uint8
+
+// LeafIndexExtension is the type of the extension in which static CT API logs
+// record the index of each entry. See https://c2sp.org/static-ct-api#sct-extension
+const LeafIndexExtension CTExtensionType = 0
+
+// CTExtension is a single extension of a TimestampedEntry or SCT.
+type CTExtension struct {
+	Type CTExtensionType
+	Data []byte
+}
+
+// ParseCTExtensions parses CtExtensions that contain a list of extensions,
+// each a one byte type followed by data with a two byte length.
+func ParseCTExtensions(data []byte) ([]CTExtension, error) {
+	var exts []CTExtension
+	for len(data) > 0 {
+		extType := CTExtensionType(data[0])
+		extData, rest, ok := readUint16Prefixed(data[1:])
+		if !ok {
+			return nil, errors.New("certificatetransparency: malformed CT extensions")
+		}
+		exts = append(exts, CTExtension{extType, extData})
+		data = rest
+	}
+	return exts, nil
+}
+
+// LeafIndex returns the index that a static CT API log recorded for the
+// entry in its leaf_index extension. ok is false if there isn't one.
+func (e *Entry) LeafIndex() (index uint64, ok bool) {
+	for _, ext := range e.Extensions {
+		if ext.Type != LeafIndexExtension {
+			continue
+		}
+		if len(ext.Data) != 5 {
+			return 0, false
+		}
+		for _, b := range ext.Data {
+			index = index<<8 | uint64(b)
+		}
+		return index, true
+	}
+	return 0, false
+}
+
 // EntryAndPosition represents a single entry in an entries file.
 type EntryAndPosition struct {
 	Index uint64
@@ -238,6 +341,11 @@ type EntryAndPosition struct {
 	Raw []byte
 	// Entry contains the parsed entry.
 	Entry *Entry
+
+	// err, if not nil, reports that the record's checksum didn't match.
+	err error
+	// codec decompresses Raw. If nil, Raw is a deflate stream.
+	codec Codec
 }
 
 func readLengthPrefixed(in io.Reader) ([]byte, error) {
@@ -252,66 +360,143 @@ func readLengthPrefixed(in io.Reader) ([]byte, error) {
 	return buf, nil
 }
 
+// An EntryParseError describes a malformed entry.
+type EntryParseError struct {
+	// Index contains the index of the entry in its entries file.
+	Index uint64
+	// Offset contains the byte offset of the entry's record from the
+	// beginning of the entries file.
+	Offset int64
+	// Field names the malformed field, e.g. "leaf_input.timestamp".
+	Field string
+	// FieldOffset contains the byte offset of the field within the
+	// uncompressed leaf_input or extra_data.
+	FieldOffset int
+	// Expected and Actual contain, for truncation errors, the number of
+	// bytes needed and the number available. Otherwise they are zero.
+	Expected, Actual int
+	// Msg describes the problem.
+	Msg string
+}
+
+func (e *EntryParseError) Error() string {
+	return fmt.Sprintf("ct: entry %d at offset %d: %s", e.Index, e.Offset, e.detail())
+}
+
+// detail describes the problem without saying where the entry is.
+func (e *EntryParseError) detail() string {
+	s := fmt.Sprintf("%s at byte %d: %s", e.Field, e.FieldOffset, e.Msg)
+	if e.Expected != 0 || e.Actual != 0 {
+		s += fmt.Sprintf(" (expected %d bytes, have %d)", e.Expected, e.Actual)
+	}
+	return s
+}
+
+// entryParser tracks the position within leaf_input or extra_data while
+// parsing, so that errors can say where they occurred.
+type entryParser struct {
+	name string
+	data []byte
+	x    []byte
+}
+
+func (p *entryParser) offset() int {
+	return len(p.data) - len(p.x)
+}
+
+func (p *entryParser) truncated(field string, expected int) error {
+	return &EntryParseError{
+		Field:       p.name + "." + field,
+		FieldOffset: p.offset(),
+		Expected:    expected,
+		Actual:      len(p.x),
+		Msg:         "truncated entry",
+	}
+}
+
+func (p *entryParser) invalid(field string, offset int, msg string) error {
+	return &EntryParseError{
+		Field:       p.name + "." + field,
+		FieldOffset: offset,
+		Msg:         msg,
+	}
+}
+
+// bytes returns the next n bytes, which make up the named field.
+func (p *entryParser) bytes(field string, n int) ([]byte, error) {
+	if len(p.x) < n {
+		return nil, p.truncated(field, n)
+	}
+	ret := p.x[:n]
+	p.x = p.x[n:]
+	return ret, nil
+}
+
+// uint24Prefixed returns the next opaque<0..2^24-1> value.
+func (p *entryParser) uint24Prefixed(field string) ([]byte, error) {
+	lenBytes, err := p.bytes(field+".length", 3)
+	if err != nil {
+		return nil, err
+	}
+	l := int(lenBytes[0])<<16 | int(lenBytes[1])<<8 | int(lenBytes[2])
+	return p.bytes(field, l)
+}
+
 func parseEntry(leafData, extraData []byte) (*Entry, error) {
-	x := leafData
-	if len(x) < 2 {
-		return nil, errors.New("ct: truncated entry")
+	p := &entryParser{name: "leaf_input", data: leafData, x: leafData}
+	header, err := p.bytes("version", 2)
+	if err != nil {
+		return nil, err
 	}
-	if x[0] != logVersion {
-		return nil, errors.New("ct: unknown entry version")
+	if header[0] != logVersion {
+		return nil, p.invalid("version", 0, "unknown entry version")
 	}
-	if x[1] != 0 {
-		return nil, errors.New("ct: unknown leaf type")
+	if header[1] != 0 {
+		return nil, p.invalid("leaf_type", 1, "unknown leaf type")
 	}
-	x = x[2:]
 
 	entry := new(Entry)
-	if len(x) < 8 {
-		return nil, errors.New("ct: truncated entry")
+	timestamp, err := p.bytes("timestamp", 8)
+	if err != nil {
+		return nil, err
 	}
-	entry.Timestamp = binary.BigEndian.Uint64(x)
-	entry.Time = time.Unix(int64(entry.Timestamp/1000), int64(entry.Timestamp%1000))
-	x = x[8:]
+	entry.Timestamp = binary.BigEndian.Uint64(timestamp)
+	entry.Time = time.Unix(int64(entry.Timestamp/1000), int64(entry.Timestamp%1000)*int64(time.Millisecond))
 
-	if len(x) < 2 {
-		return nil, errors.New("ct: truncated entry")
+	entryType, err := p.bytes("entry_type", 2)
+	if err != nil {
+		return nil, err
 	}
-	entry.Type = LogEntryType(x[1])
-	x = x[2:]
+	entry.Type = LogEntryType(entryType[1])
 	switch entry.Type {
 	case X509Entry:
-		if len(x) < 3 {
-			return nil, errors.New("ct: truncated entry")
+		if entry.X509Cert, err = p.uint24Prefixed("signed_entry"); err != nil {
+			return nil, err
 		}
-		l := int(x[0])<<16 |
-			int(x[1])<<8 |
-			int(x[2])
-		x = x[3:]
-		if len(x) < l {
-			return nil, errors.New("ct: truncated entry")
-		}
-		entry.X509Cert = x[:l]
-		x = x[l:]
 	case PreCertEntry:
-		if len(x) < 32 {
-			return nil, errors.New("ct: truncated entry")
-		}
-		entry.PreCertIssuerHash = x[:32]
-		x = x[32:]
-		if len(x) < 2 {
-			return nil, errors.New("ct: truncated entry")
+		if entry.PreCertIssuerHash, err = p.bytes("issuer_key_hash", 32); err != nil {
+			return nil, err
 		}
-		l := int(x[0])<<8 | int(x[1])
-		if len(x) < l {
-			return nil, errors.New("ct: truncated entry")
+		if entry.TBSCert, err = p.uint24Prefixed("tbs_certificate"); err != nil {
+			return nil, err
 		}
-		entry.TBSCert = x[:l]
 	default:
-		return nil, errors.New("ct: unknown entry type")
+		return nil, p.invalid("entry_type", p.offset()-2, "unknown entry type")
 	}
 
-	x = extraData
-	if len(x) > 0 {
+	extLen, err := p.bytes("extensions.length", 2)
+	if err != nil {
+		return nil, err
+	}
+	if entry.RawExtensions, err = p.bytes("extensions", int(extLen[0])<<8|int(extLen[1])); err != nil {
+		return nil, err
+	}
+	entry.Extensions, _ = ParseCTExtensions(entry.RawExtensions)
+	if len(p.x) != 0 {
+		return nil, p.invalid("extensions", p.offset(), "trailing data after entry")
+	}
+
+	if len(extraData) > 0 {
 		// For an X509Entry, the contents are:
 		//   ASN.1Cert certificate_chain<0..2^24-1>;
 		// For a PreCertEntry, however, the contents are:
@@ -319,42 +504,31 @@ func parseEntry(leafData, extraData []byte) (*Entry, error) {
 		//   ASN.1Cert pre_certificate;
 		//   ASN.1Cert precertificate_chain<0..2^24-1>;
 		// } PrecertChainEntry;
-		if len(x) < 3 {
-			return nil, errors.New("ct: extra data truncated")
-		}
-		l := int(x[0])<<16 | int(x[1])<<8 | int(x[2])
-		x = x[3:]
+		p = &entryParser{name: "extra_data", data: extraData, x: extraData}
 
 		if entry.Type == PreCertEntry {
-			if l > len(x) {
-				return nil, errors.New("ct: extra data truncated")
+			preCert, err := p.uint24Prefixed("pre_certificate")
+			if err != nil {
+				return nil, err
 			}
-			entry.ExtraCerts = append(entry.ExtraCerts, x[:l])
-			x = x[l:]
-
-			if len(x) < 3 {
-				return nil, errors.New("ct: extra data truncated")
-			}
-			l = int(x[0])<<16 | int(x[1])<<8 | int(x[2])
-			x = x[3:]
+			entry.ExtraCerts = append(entry.ExtraCerts, preCert)
 		}
 
-		if l != len(x) {
-			return nil, errors.New("ct: extra data truncated")
+		chain, err := p.uint24Prefixed("certificate_chain")
+		if err != nil {
+			return nil, err
+		}
+		if len(p.x) != 0 {
+			return nil, p.invalid("certificate_chain", p.offset(), "trailing data after chain")
 		}
 
-		for len(x) > 0 {
-			if len(x) < 3 {
-				return nil, errors.New("ct: extra data truncated")
-			}
-			l := int(x[0])<<16 | int(x[1])<<8 | int(x[2])
-			x = x[3:]
-
-			if l > len(x) {
-				return nil, errors.New("ct: extra data truncated")
+		p = &entryParser{name: p.name + ".certificate_chain", data: chain, x: chain}
+		for len(p.x) > 0 {
+			cert, err := p.uint24Prefixed("certificate")
+			if err != nil {
+				return nil, err
 			}
-			entry.ExtraCerts = append(entry.ExtraCerts, x[:l])
-			x = x[l:]
+			entry.ExtraCerts = append(entry.ExtraCerts, cert)
 		}
 	}
 
@@ -364,22 +538,184 @@ func parseEntry(leafData, extraData []byte) (*Entry, error) {
 	return entry, nil
 }
 
-func (e *EntryAndPosition) Parse() error {
-	z := flate.NewReader(bytes.NewBuffer(e.Raw))
-	leafInput, err := readLengthPrefixed(z)
+// Certificate parses the certificate in the entry. For a PreCertEntry, the
+// result is built from TBSCert: it has the names, validity period and issuer
+// that were logged, but no valid signature.
+func (e *Entry) Certificate() (*x509.Certificate, error) {
+	switch e.Type {
+	case X509Entry:
+		return x509.ParseCertificate(e.X509Cert)
+	case PreCertEntry:
+		return parseTBSCertificate(e.TBSCert)
+	}
+	return nil, errors.New("ct: unknown entry type")
+}
+
+// precertSigningOID is the extended key usage that marks a Precertificate
+// Signing Certificate. See https://tools.ietf.org/html/rfc6962#section-3.1
+var precertSigningOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 4}
+
+// Chain parses the chain of certificates that the log recorded for the
+// entry, starting with the certificate that issued the leaf (or
+// precertificate) and ending closest to the root.
+func (e *Entry) Chain() ([]*x509.Certificate, error) {
+	chain := e.ExtraCerts
+	if e.Type == PreCertEntry && len(chain) > 0 {
+		chain = chain[1:]
+	}
+
+	var certs []*x509.Certificate
+	for _, der := range chain {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// isPrecertSigningCert returns whether cert is a Precertificate Signing
+// Certificate.
+func isPrecertSigningCert(cert *x509.Certificate) bool {
+	for _, usage := range cert.UnknownExtKeyUsage {
+		if usage.Equal(precertSigningOID) {
+			return true
+		}
+	}
+	return false
+}
+
+// PrecertSigningCert returns the Precertificate Signing Certificate that
+// issued a precertificate entry, or nil if the precertificate was issued
+// directly by its CA or the entry isn't a PreCertEntry.
+func (e *Entry) PrecertSigningCert() (*x509.Certificate, error) {
+	if e.Type != PreCertEntry {
+		return nil, nil
+	}
+	chain, err := e.Chain()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	extraData, err := readLengthPrefixed(z)
+	if len(chain) > 0 && isPrecertSigningCert(chain[0]) {
+		return chain[0], nil
+	}
+	return nil, nil
+}
+
+// Issuer returns the CA certificate that issued the entry's certificate. For
+// a precertificate issued by a Precertificate Signing Certificate this is
+// the CA that owns the signing certificate, which is also the issuer of the
+// final certificate. It returns nil if the log recorded no chain.
+func (e *Entry) Issuer() (*x509.Certificate, error) {
+	chain, err := e.Chain()
+	if err != nil {
+		return nil, err
+	}
+	if len(chain) == 0 {
+		return nil, nil
+	}
+	if e.Type == PreCertEntry && isPrecertSigningCert(chain[0]) {
+		if len(chain) < 2 {
+			return nil, errors.New("ct: Precertificate Signing Certificate without issuer")
+		}
+		return chain[1], nil
+	}
+	return chain[0], nil
+}
+
+// parseTBSCertificate parses a DER encoded TBSCertificate by wrapping it in a
+// Certificate structure with an empty signature.
+func parseTBSCertificate(tbs []byte) (*x509.Certificate, error) {
+	var tbsSeq asn1.RawValue
+	if _, err := asn1.Unmarshal(tbs, &tbsSeq); err != nil {
+		return nil, err
+	}
+
+	// The signature algorithm in the Certificate must match the one in the
+	// TBSCertificate, which follows the optional version and the serial
+	// number.
+	x := tbsSeq.Bytes
+	var field asn1.RawValue
+	var err error
+	if x, err = asn1.Unmarshal(x, &field); err != nil {
+		return nil, err
+	}
+	if field.Class == asn1.ClassContextSpecific && field.Tag == 0 {
+		if x, err = asn1.Unmarshal(x, &field); err != nil {
+			return nil, err
+		}
+	}
+	var sigAlg asn1.RawValue
+	if _, err = asn1.Unmarshal(x, &sigAlg); err != nil {
+		return nil, err
+	}
+
+	cert, err := asn1.Marshal(struct {
+		TBS    asn1.RawValue
+		SigAlg asn1.RawValue
+		Sig    asn1.BitString
+	}{asn1.RawValue{FullBytes: tbs}, sigAlg, asn1.BitString{}})
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(cert)
+}
+
+// Parse decompresses and parses the entry. Errors are of type
+// *EntryParseError.
+func (e *EntryAndPosition) Parse() error {
+	leafInput, extraData, err := e.decompress()
 	if err != nil {
 		return err
 	}
-	z.Close()
 
 	e.Entry, err = parseEntry(leafInput, extraData)
 	if err != nil {
-		return err
+		if parseErr, ok := err.(*EntryParseError); ok {
+			parseErr.Index = e.Index
+			parseErr.Offset = e.Offset
+			return parseErr
+		}
+		return &EntryParseError{Index: e.Index, Offset: e.Offset, Field: "entry", Msg: err.Error()}
 	}
 
 	return nil
 }
+
+// decompress checks the record's checksum, if any, and returns the
+// leaf_input and extra_data of the entry.
+func (e *EntryAndPosition) decompress() (leafInput, extraData []byte, err error) {
+	if e.err != nil {
+		return nil, nil, e.err
+	}
+
+	codec := e.codec
+	if codec == nil {
+		codec = flateCodec{}
+	}
+	data, err := codec.Decompress(e.Raw)
+	if err != nil {
+		return nil, nil, e.parseError("record", err)
+	}
+	z := bytes.NewReader(data)
+	if leafInput, err = readLengthPrefixed(z); err != nil {
+		return nil, nil, e.parseError("leaf_input", err)
+	}
+	if extraData, err = readLengthPrefixed(z); err != nil {
+		return nil, nil, e.parseError("extra_data", err)
+	}
+	return leafInput, extraData, nil
+}
+
+// parseError returns an *EntryParseError for a failure to decompress the
+// named field of e.
+func (e *EntryAndPosition) parseError(field string, err error) error {
+	return &EntryParseError{
+		Index:  e.Index,
+		Offset: e.Offset,
+		Field:  field,
+		Msg:    "decompression failed: " + err.Error(),
+	}
+}
@@ -0,0 +1,215 @@
+package certificatetransparency
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHashTreeCorruptRecord(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "entries")
+	f, _, err := OpenEntriesFile(fileName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	a, err := f.NewAppender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const count = 100
+	for i := 0; i < count; i++ {
+		if err := a.Append(&RawEntry{LeafInput: []byte{byte(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := new(CompactRange)
+	for i := 0; i < count; i++ {
+		want.Append(LeafHash([]byte{byte(i)}))
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	root, err := f.HashTree(nil, count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != want.Root() {
+		t.Fatal("HashTree returned the wrong root")
+	}
+
+	// Flip a bit in the last byte of the file, which is in the last
+	// record's compressed data.
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+	last[0] ^= 1
+	if _, err := f.WriteAt(last, info.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	status := make(chan OperationStatus)
+	go func() {
+		for range status {
+		}
+	}()
+	_, err = f.HashTree(status, count)
+	parseErr, ok := err.(*EntryParseError)
+	if !ok {
+		t.Fatalf("HashTree returned %v, want an *EntryParseError", err)
+	}
+	if parseErr.Index != count-1 {
+		t.Errorf("error is for entry %d, want %d", parseErr.Index, count-1)
+	}
+}
+
+func TestParseEntryExtensions(t *testing.T) {
+	leaf := func(extensions ...byte) []byte {
+		b := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 3, 'a', 'b', 'c'}
+		b = append(b, 0, byte(len(extensions)))
+		return append(b, extensions...)
+	}
+
+	tests := []struct {
+		name       string
+		extensions []byte
+		count      int
+		index      uint64
+		hasIndex   bool
+	}{
+		{"empty", nil, 0, 0, false},
+		{"leaf index", []byte{0, 0, 5, 0, 0, 0, 1, 2}, 1, 258, true},
+		{"other then leaf index", []byte{7, 0, 1, 9, 0, 0, 5, 1, 0, 0, 0, 0}, 2, 1 << 32, true},
+		{"short leaf index", []byte{0, 0, 4, 0, 0, 1, 2}, 1, 0, false},
+		{"opaque", []byte{0, 0, 9}, 0, 0, false},
+	}
+	for _, test := range tests {
+		entry, err := parseEntry(leaf(test.extensions...), nil)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !bytes.Equal(entry.RawExtensions, test.extensions) {
+			t.Errorf("%s: RawExtensions is %x", test.name, entry.RawExtensions)
+		}
+		if len(entry.Extensions) != test.count {
+			t.Errorf("%s: got %d extensions, want %d", test.name, len(entry.Extensions), test.count)
+		}
+		index, ok := entry.LeafIndex()
+		if ok != test.hasIndex || index != test.index {
+			t.Errorf("%s: LeafIndex returned %d, %t", test.name, index, ok)
+		}
+	}
+}
+
+// precertLeaf returns the leaf_input of a PreCertEntry for tbs.
+func precertLeaf(issuerKeyHash, tbs []byte) []byte {
+	b := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, byte(PreCertEntry)}
+	b = append(b, issuerKeyHash...)
+	b = appendUint24(b, len(tbs))
+	b = append(b, tbs...)
+	return append(b, 0, 0)
+}
+
+func TestPrecertEntryLargeTBS(t *testing.T) {
+	ca := newTestCA(t)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "large.example"},
+		NotBefore:    time.Unix(1500000000, 0),
+		NotAfter:     time.Unix(1600000000, 0),
+		ExtraExtensions: []pkix.Extension{{
+			Id:    asn1.ObjectIdentifier{1, 2, 3, 4},
+			Value: make([]byte, 70000),
+		}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &ca.key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbs := cert.RawTBSCertificate
+	if len(tbs) <= 0xffff {
+		t.Fatalf("TBSCertificate is only %d bytes", len(tbs))
+	}
+
+	entry, err := parseEntry(precertLeaf(make([]byte, 32), tbs), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(entry.TBSCert, tbs) {
+		t.Fatalf("TBSCert is %d bytes, want %d", len(entry.TBSCert), len(tbs))
+	}
+	parsed, err := entry.Certificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Subject.CommonName != "large.example" || !bytes.Equal(parsed.RawTBSCertificate, tbs) {
+		t.Errorf("Certificate returned %q", parsed.Subject.CommonName)
+	}
+}
+
+func TestPrecertEntryTruncated(t *testing.T) {
+	ca := newTestCA(t)
+	tbs := ca.cert.RawTBSCertificate
+	leaf := precertLeaf(make([]byte, 32), tbs)
+	const tbsOffset = 12 + 32
+
+	tests := []struct {
+		name  string
+		leaf  []byte
+		field string
+	}{
+		{"issuer_key_hash", leaf[:12+10], "leaf_input.issuer_key_hash"},
+		{"tbs_certificate length", leaf[:tbsOffset+2], "leaf_input.tbs_certificate.length"},
+		{"tbs_certificate", leaf[:tbsOffset+3+len(tbs)/2], "leaf_input.tbs_certificate"},
+		{"extensions", leaf[:len(leaf)-1], "leaf_input.extensions.length"},
+	}
+	for _, test := range tests {
+		_, err := parseEntry(test.leaf, nil)
+		parseErr, ok := err.(*EntryParseError)
+		if !ok {
+			t.Errorf("%s: parseEntry returned %v, want an *EntryParseError", test.name, err)
+			continue
+		}
+		if parseErr.Field != test.field {
+			t.Errorf("%s: error is for %s", test.name, parseErr.Field)
+		}
+	}
+
+	// A TBSCertificate that is complete as far as the entry is concerned
+	// but whose DER is cut short can't be parsed.
+	for _, n := range []int{0, 1, 4, len(tbs) / 2, len(tbs) - 1} {
+		entry, err := parseEntry(precertLeaf(make([]byte, 32), tbs[:n]), nil)
+		if err != nil {
+			t.Errorf("%d bytes of TBSCertificate: %s", n, err)
+			continue
+		}
+		if _, err := entry.Certificate(); err == nil {
+			t.Errorf("%d bytes of TBSCertificate: Certificate succeeded", n)
+		}
+	}
+}
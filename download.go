@@ -0,0 +1,362 @@
+package certificatetransparency
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// maxDownloadBatchSize is the largest number of entries that DownloadRange
+// will request in a single get-entries call.
+const maxDownloadBatchSize = 2000
+
+// downloadResult contains the entries fetched for one batch of DownloadRange.
+type downloadResult struct {
+	start uint64
+	ents  []RawEntry
+	err   error
+}
+
+// syncer is implemented by writers, such as *EntriesAppender and *os.File,
+// that can flush written data to stable storage.
+type syncer interface {
+	Sync() error
+}
+
+// downloadBatch is a range of entries, from start till one less than end.
+type downloadBatch struct {
+	start, end uint64
+}
+
+// batchSize returns the number of entries to request from the log at once.
+// For a tiled log that is the width of a tile.
+func (log *Log) batchSize() uint64 {
+	if len(log.TileRoot) > 0 {
+		return tileWidth
+	}
+	log.batchMu.Lock()
+	defer log.batchMu.Unlock()
+	if log.BatchSize == 0 || log.BatchSize > maxDownloadBatchSize {
+		return maxDownloadBatchSize
+	}
+	return log.BatchSize
+}
+
+// observeBatch records that the log returned n entries in response to a
+// request for more. If that's less than the current batch size then the
+// batch size is reduced to match.
+func (log *Log) observeBatch(n uint64) {
+	log.batchMu.Lock()
+	defer log.batchMu.Unlock()
+	if log.BatchSize == 0 || n < log.BatchSize {
+		log.BatchSize = n
+	}
+}
+
+// setBatchSize records n as the batch size, which may be larger than before.
+func (log *Log) setBatchSize(n uint64) {
+	log.batchMu.Lock()
+	defer log.batchMu.Unlock()
+	log.BatchSize = n
+}
+
+// CurrentBatchSize returns log.BatchSize. Unlike reading the field directly,
+// it is safe to call while DownloadRange is running.
+func (log *Log) CurrentBatchSize() uint64 {
+	log.batchMu.Lock()
+	defer log.batchMu.Unlock()
+	return log.BatchSize
+}
+
+var (
+	// ErrNoEntries is returned when a log returns no entries for a range
+	// that it should have entries for.
+	ErrNoEntries = errors.New("certificatetransparency: log returned no entries")
+	// ErrTooManyEntries is returned when a log returns more entries than
+	// were requested.
+	ErrTooManyEntries = errors.New("certificatetransparency: log returned more entries than requested")
+)
+
+// An InvalidEntryError is returned by DownloadRange when a log returns
+// entries that fail validation. Nothing from the failing entry onwards is
+// written.
+type InvalidEntryError struct {
+	// Log contains the root URL of the log.
+	Log string
+	// Index contains the index of the first invalid entry.
+	Index uint64
+	// Err describes the problem. If it is an *EntryParseError then its
+	// Index is also that of the entry and its Offset is zero, since the
+	// entry isn't in a file.
+	Err error
+}
+
+func (e *InvalidEntryError) Error() string {
+	// An *EntryParseError has no file offset here, so only its
+	// description is included.
+	if parseErr, ok := e.Err.(*EntryParseError); ok {
+		return fmt.Sprintf("certificatetransparency: invalid entry %d from %s: %s", e.Index, e.Log, parseErr.detail())
+	}
+	return fmt.Sprintf("certificatetransparency: invalid entry %d from %s: %s", e.Index, e.Log, e.Err)
+}
+
+func (e *InvalidEntryError) Unwrap() error {
+	return e.Err
+}
+
+// validateEntries checks the entries that the log returned in response to a
+// request for the entries from start till one less than end. It returns the
+// entries that passed, which are a prefix of batch, and an error describing
+// the first that failed, if any.
+func (log *Log) validateEntries(batch []RawEntry, start, end uint64) ([]RawEntry, error) {
+	if len(batch) == 0 {
+		return nil, &InvalidEntryError{log.Root, start, ErrNoEntries}
+	}
+	if uint64(len(batch)) > end-start {
+		return nil, &InvalidEntryError{log.Root, start, ErrTooManyEntries}
+	}
+
+	for i, ent := range batch {
+		if _, err := parseEntry(ent.LeafInput, ent.ExtraData); err != nil {
+			if parseErr, ok := err.(*EntryParseError); ok {
+				parseErr.Index = start + uint64(i)
+			}
+			return batch[:i], &InvalidEntryError{log.Root, start + uint64(i), err}
+		}
+	}
+
+	return batch, nil
+}
+
+// getEntryRange fetches all the entries from start till one less than end,
+// making as many requests as needed if the log returns short responses.
+func (log *Log) getEntryRange(ctx context.Context, start, end uint64) ([]RawEntry, error) {
+	if len(log.TileRoot) > 0 {
+		return log.getTileEntryRange(ctx, start, end)
+	}
+
+	var ents []RawEntry
+	for next := start; next < end; {
+		batch, err := log.GetEntries(ctx, next, end-1)
+		if err != nil {
+			return ents, err
+		}
+		if batch, err = log.validateEntries(batch, next, end); err != nil {
+			return append(ents, batch...), err
+		}
+		if uint64(len(batch)) < end-next && next%uint64(len(batch)) == 0 {
+			// A short response to an aligned request reveals the
+			// log's page size.
+			log.observeBatch(uint64(len(batch)))
+		}
+		ents = append(ents, batch...)
+		next += uint64(len(batch))
+	}
+	return ents, nil
+}
+
+// learnBatchSize probes the log to discover how many entries it returns per
+// request, starting at index start. Since logs may cut short responses at a
+// page boundary, a short first response is followed by a second request
+// starting at that boundary. What it learns replaces the current batch size,
+// which may therefore grow. The entries fetched are returned.
+func (log *Log) learnBatchSize(ctx context.Context, start, upTo uint64) ([]RawEntry, error) {
+	var ents []RawEntry
+	for next := start; next < upTo && len(ents) < 2*maxDownloadBatchSize; {
+		end := next + maxDownloadBatchSize
+		if end > upTo {
+			end = upTo
+		}
+		batch, err := log.GetEntries(ctx, next, end-1)
+		if err != nil {
+			return ents, err
+		}
+		if batch, err = log.validateEntries(batch, next, end); err != nil {
+			return append(ents, batch...), err
+		}
+		ents = append(ents, batch...)
+		next += uint64(len(batch))
+
+		if next == end {
+			// The log returned everything that was asked for so
+			// there's nothing to learn from a second request.
+			if end-start >= maxDownloadBatchSize {
+				log.setBatchSize(maxDownloadBatchSize)
+			}
+			break
+		}
+		if len(ents) > len(batch) {
+			// Second request: the page size is the larger of
+			// the two responses.
+			n := uint64(len(batch))
+			if first := uint64(len(ents) - len(batch)); first > n {
+				n = first
+			}
+			log.setBatchSize(n)
+			break
+		}
+	}
+	return ents, nil
+}
+
+// DownloadRange downloads log entries from the given starting index till one
+// less than upTo. If status is not nil then status updates will be written to
+// it until the function is complete, when it will be closed. The log entries
+// will be compressed and written to out in the format of an EntriesFile
+// without a header or, if out is an *EntriesAppender, in the format of its
+// file. It returns the new starting index (i.e.  start + the number of entries
+// downloaded).
+//
+// Up to log.DownloadWorkers batches are fetched concurrently, but entries are
+// always written to out in order. Requests are aligned to multiples of
+// log.BatchSize. Unless that is already the largest size that DownloadRange
+// requests, it is first learnt afresh from the log's responses, and the result
+// is available from log.CurrentBatchSize on return. While downloading, a
+// short response to an aligned request reduces the batch size for the rest of
+// the call; a later call learns it again, so a transient short response
+// doesn't reduce throughput permanently. All of DownloadRange's goroutines
+// have finished when it returns.
+//
+// Entries are validated before they are written and DownloadRange stops at
+// the first invalid entry with an *InvalidEntryError.
+//
+// If log.TileRoot is set then entries are rebuilt from the log's data tiles,
+// one tile per batch, and checked against the hash tiles of the checkpoint
+// last fetched by GetSignedTreeHead. upTo may not exceed that checkpoint's
+// tree size.
+//
+// If out has a Sync method, such as an *EntriesAppender, then it is called
+// after each batch is written, and before returning, so that an interrupted
+// download loses at most one batch.
+func (log *Log) DownloadRange(ctx context.Context, out io.Writer, status chan<- OperationStatus, start, upTo uint64) (done uint64, err error) {
+	if status != nil {
+		defer close(status)
+	}
+	endBatch := func() error { return nil }
+	if s, ok := out.(syncer); ok {
+		endBatch = s.Sync
+		defer func() {
+			if syncErr := s.Sync(); err == nil {
+				err = syncErr
+			}
+		}()
+	}
+
+	done = start
+	learn := log.CurrentBatchSize() < maxDownloadBatchSize && len(log.TileRoot) == 0
+	if learn && done < upTo {
+		if status != nil {
+			status <- OperationStatus{start, done, upTo}
+		}
+		ents, err := log.learnBatchSize(ctx, done, upTo)
+		for _, ent := range ents {
+			if err := writeEntry(out, &ent); err != nil {
+				return done, err
+			}
+			done++
+		}
+		if err != nil {
+			return done, err
+		}
+		if err := endBatch(); err != nil {
+			return done, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	wg := new(sync.WaitGroup)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	workers := log.DownloadWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	// inFlight limits how far the fetched batches may run ahead of the
+	// batch that is next to be written.
+	inFlight := make(chan struct{}, 2*workers)
+	batches := make(chan downloadBatch)
+	results := make(chan downloadResult, workers)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(batches)
+		for next := done; next < upTo; {
+			size := log.batchSize()
+			end := (next/size + 1) * size
+			if end > upTo {
+				end = upTo
+			}
+
+			select {
+			case inFlight <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case batches <- downloadBatch{next, end}:
+			case <-ctx.Done():
+				return
+			}
+			next = end
+		}
+	}()
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				ents, err := log.getEntryRange(ctx, batch.start, batch.end)
+				select {
+				case results <- downloadResult{batch.start, ents, err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	pending := make(map[uint64]downloadResult)
+	for done < upTo {
+		if status != nil {
+			status <- OperationStatus{start, done, upTo}
+		}
+
+		result, ok := pending[done]
+		if !ok {
+			if result, ok = <-results; !ok {
+				return done, ctx.Err()
+			}
+			pending[result.start] = result
+			continue
+		}
+		delete(pending, done)
+
+		for _, ent := range result.ents {
+			if err := writeEntry(out, &ent); err != nil {
+				return done, err
+			}
+			done++
+		}
+		if result.err != nil {
+			return done, result.err
+		}
+		if err := endBatch(); err != nil {
+			return done, err
+		}
+		<-inFlight
+	}
+
+	return done, nil
+}
@@ -0,0 +1,73 @@
+package certificatetransparency
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testLeaf returns the leaf_input of an X509Entry with timestamp i.
+func testLeaf(i uint64) []byte {
+	leaf := binary.BigEndian.AppendUint64([]byte{0, 0}, i)
+	return append(leaf, 0, 0, 0, 0, 1, 'c', 0, 0)
+}
+
+// pagedLogServer serves get-entries for a log of size entries, returning at
+// most page entries per request, aligned to multiples of page.
+func pagedLogServer(size, page uint64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start, _ := strconv.ParseUint(r.URL.Query().Get("start"), 10, 64)
+		end, _ := strconv.ParseUint(r.URL.Query().Get("end"), 10, 64)
+		if end >= size {
+			end = size - 1
+		}
+		if pageEnd := (start/page+1)*page - 1; end > pageEnd {
+			end = pageEnd
+		}
+		var resp entries
+		for i := start; i <= end; i++ {
+			resp.Entries = append(resp.Entries, RawEntry{LeafInput: testLeaf(i)})
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+}
+
+func TestDownloadRangeBatchSizeRecovers(t *testing.T) {
+	srv := pagedLogServer(3000, 500)
+	defer srv.Close()
+
+	// A batch size below the log's page size, as left by a transient
+	// short response, is learnt again.
+	log := &Log{Root: srv.URL, DownloadWorkers: 4, BatchSize: 100}
+	var out bytes.Buffer
+	done, err := log.DownloadRange(context.Background(), &out, nil, 0, 3000)
+	if err != nil || done != 3000 {
+		t.Fatalf("DownloadRange returned %d, %v", done, err)
+	}
+	if size := log.CurrentBatchSize(); size != 500 {
+		t.Errorf("batch size is %d, want 500", size)
+	}
+}
+
+func TestInvalidEntryErrorIndex(t *testing.T) {
+	log := &Log{Root: "https://log.example/"}
+	_, err := log.validateEntries([]RawEntry{{LeafInput: []byte{0}}}, 1234, 1235)
+
+	var parseErr *EntryParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("got %v, want an *EntryParseError", err)
+	}
+	if parseErr.Index != 1234 {
+		t.Errorf("EntryParseError has index %d, want 1234", parseErr.Index)
+	}
+	if msg := err.Error(); strings.Contains(msg, "entry 0") || !strings.Contains(msg, "entry 1234") {
+		t.Errorf("unexpected message %q", msg)
+	}
+}
@@ -0,0 +1,339 @@
+package certificatetransparency
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Entries files written by older versions of this package are a series of
+// records, each a uint32 length followed by a deflate stream. Newer files
+// start with a header:
+//
+//	magic    [8]byte  entriesMagic
+//	version  uint32   entriesFormatVersion
+//	length   uint32   length of the metadata
+//	metadata [length]byte, JSON encoded FileHeader
+//
+// and each record contains a uint32 length, then a CRC32C of the length and
+// the compressed data, then the entry compressed by the file's Codec. In
+// version 1 files the CRC32C covers only the compressed data, so a damaged
+// length goes unnoticed until the records after it fail to parse. All
+// integers are little-endian.
+//
+// The metadata records the log that the entries came from and how they are
+// compressed and checked. Files without a header can be converted with
+// MigrateEntriesFile.
+
+// entriesMagic starts an entries file with a header. As a record length its
+// first four bytes would be over a gigabyte, so it can't be confused with
+// the start of a file without a header.
+const entriesMagic = "\x89CTLOG\r\n"
+
+// entriesFormatVersion is the version of the file format written by this
+// package.
+const entriesFormatVersion = 2
+
+// ChecksumCRC32C is the value of FileHeader.Checksum when each record has a
+// CRC32C (Castagnoli) checksum.
+const ChecksumCRC32C = "crc32c"
+
+// maxHeaderSize is the largest metadata that will be read from a header.
+const maxHeaderSize = 1 << 20
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// FileHeader contains the header of an entries file.
+type FileHeader struct {
+	// Version contains the format version, or zero for a file without a
+	// header.
+	Version uint32 `json:"-"`
+	// LogURL contains the root URL of the log that the entries are from.
+	LogURL string `json:"log_url,omitempty"`
+	// LogID contains the ID of that log.
+	LogID []byte `json:"log_id,omitempty"`
+	// Codec names the compression used for each entry.
+	Codec string `json:"codec"`
+	// Dictionary contains the dictionary for CodecZstd.
+	Dictionary []byte `json:"dictionary,omitempty"`
+	// Checksum names the checksum stored in each record, or is empty if
+	// records have no checksum.
+	Checksum string `json:"checksum,omitempty"`
+
+	// size contains the length of the encoded header, which is the offset
+	// of the first record.
+	size int64
+}
+
+// CodecFlate is the value of FileHeader.Codec when each entry is compressed
+// as a separate deflate stream. Files without a header always use it.
+const CodecFlate = "flate"
+
+// NewFileHeader returns the header for a new entries file holding the entries
+// of log, which may be nil if the log isn't known.
+func NewFileHeader(log *Log) *FileHeader {
+	h := &FileHeader{
+		Version:  entriesFormatVersion,
+		Codec:    CodecFlate,
+		Checksum: ChecksumCRC32C,
+	}
+	if log != nil {
+		id := log.ID()
+		h.LogURL = log.Root
+		h.LogID = id[:]
+	}
+	return h
+}
+
+// MatchesLog returns false if the header records a log ID other than that of
+// log.
+func (h *FileHeader) MatchesLog(log *Log) bool {
+	id := log.ID()
+	return len(h.LogID) == 0 || bytes.Equal(h.LogID, id[:])
+}
+
+// Size returns the number of bytes that the header occupies at the start of
+// the file. Records start at this offset.
+func (h *FileHeader) Size() int64 {
+	return h.size
+}
+
+// marshal encodes h.
+func (h *FileHeader) marshal() ([]byte, error) {
+	metadata, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(entriesMagic)+4+4+len(metadata))
+	out = append(out, entriesMagic...)
+	out = binary.LittleEndian.AppendUint32(out, h.Version)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(metadata)))
+	return append(out, metadata...), nil
+}
+
+// Header reads the header of f. A file without a header, including an empty
+// file, results in a header with a Version of zero and no log metadata.
+func (f EntriesFile) Header() (*FileHeader, error) {
+	var fixed [len(entriesMagic) + 4 + 4]byte
+	n, err := f.ReadAt(fixed[:], 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n < len(entriesMagic) || string(fixed[:len(entriesMagic)]) != entriesMagic {
+		return &FileHeader{Codec: CodecFlate}, nil
+	}
+	if n < len(fixed) {
+		return nil, errors.New("certificatetransparency: truncated entries file header")
+	}
+
+	h := &FileHeader{Version: binary.LittleEndian.Uint32(fixed[len(entriesMagic):])}
+	if h.Version == 0 || h.Version > entriesFormatVersion {
+		return nil, fmt.Errorf("certificatetransparency: unsupported entries file version %d", h.Version)
+	}
+	length := binary.LittleEndian.Uint32(fixed[len(entriesMagic)+4:])
+	if length > maxHeaderSize {
+		return nil, errors.New("certificatetransparency: entries file header too large")
+	}
+	metadata := make([]byte, length)
+	if _, err := f.ReadAt(metadata, int64(len(fixed))); err != nil {
+		if err == io.EOF {
+			return nil, errors.New("certificatetransparency: truncated entries file header")
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(metadata, h); err != nil {
+		return nil, err
+	}
+	if _, err := h.EntryCodec(); err != nil {
+		return nil, err
+	}
+	switch h.Checksum {
+	case "", ChecksumCRC32C:
+	default:
+		return nil, fmt.Errorf("certificatetransparency: unknown checksum %q in entries file header", h.Checksum)
+	}
+	h.size = int64(len(fixed)) + int64(length)
+
+	return h, nil
+}
+
+// recordOverhead returns the number of bytes in each record before the
+// compressed data.
+func (h *FileHeader) recordOverhead() int {
+	if len(h.Checksum) > 0 {
+		return 8
+	}
+	return 4
+}
+
+// appendRecord appends a record containing the compressed data z to out.
+func (h *FileHeader) appendRecord(out, z []byte) []byte {
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(z)))
+	if len(h.Checksum) > 0 {
+		out = binary.LittleEndian.AppendUint32(out, h.recordChecksum(z))
+	}
+	return append(out, z...)
+}
+
+// checksumMatches returns false if the record with the given prefix and
+// compressed data z has a checksum and it doesn't match.
+func (h *FileHeader) checksumMatches(prefix, z []byte) bool {
+	if len(h.Checksum) == 0 {
+		return true
+	}
+	return h.recordChecksum(z) == binary.LittleEndian.Uint32(prefix[4:])
+}
+
+// recordChecksum returns the checksum of the record with compressed data z.
+func (h *FileHeader) recordChecksum(z []byte) uint32 {
+	var crc uint32
+	if h.Version >= 2 {
+		crc = crc32.Update(crc, crc32c, binary.LittleEndian.AppendUint32(nil, uint32(len(z))))
+	}
+	return crc32.Update(crc, crc32c, z)
+}
+
+// recordReader reads the records of an entries file in order.
+type recordReader struct {
+	header *FileHeader
+	codec  Codec
+	in     *bufio.Reader
+	// offset contains the file offset of the next record and end the
+	// offset of the end of the file.
+	offset, end int64
+	// index contains the index of the next record.
+	index uint64
+}
+
+// newRecordReader returns a recordReader that reads the records from the
+// given offset, which is that of the record with the given index. If offset
+// is within the header then reading starts at the first record.
+func (f EntriesFile) newRecordReader(h *FileHeader, offset int64, index uint64) (*recordReader, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	codec, err := h.EntryCodec()
+	if err != nil {
+		return nil, err
+	}
+	if offset < h.size {
+		offset = h.size
+	}
+	if offset > info.Size() {
+		offset = info.Size()
+	}
+	return &recordReader{
+		header: h,
+		codec:  codec,
+		in:     bufio.NewReaderSize(io.NewSectionReader(f, offset, info.Size()-offset), 1<<16),
+		offset: offset,
+		end:    info.Size(),
+		index:  index,
+	}, nil
+}
+
+// next reads the next record. At the end of the file it returns io.EOF and
+// for an incomplete record it returns an *EntryParseError. If skip is true
+// then the record's contents are not read. Otherwise, if the record's
+// checksum is wrong, that is reported when the entry is parsed.
+func (r *recordReader) next(skip bool) (*EntryAndPosition, error) {
+	if r.offset == r.end {
+		return nil, io.EOF
+	}
+
+	overhead := r.header.recordOverhead()
+	var prefix [8]byte
+	if r.end-r.offset < int64(overhead) {
+		return nil, &EntryParseError{Index: r.index, Offset: r.offset, Field: "record.length", Expected: overhead, Actual: int(r.end - r.offset), Msg: "truncated record"}
+	}
+	if _, err := io.ReadFull(r.in, prefix[:overhead]); err != nil {
+		return nil, err
+	}
+	zLen := binary.LittleEndian.Uint32(prefix[:])
+	if available := r.end - r.offset - int64(overhead); int64(zLen) > available {
+		return nil, &EntryParseError{Index: r.index, Offset: r.offset, Field: "record", FieldOffset: overhead, Expected: int(zLen), Actual: int(available), Msg: "truncated record"}
+	}
+
+	ent := &EntryAndPosition{
+		Index:  r.index,
+		Offset: r.offset,
+		Length: overhead + int(zLen),
+		codec:  r.codec,
+	}
+	if skip {
+		if _, err := r.in.Discard(int(zLen)); err != nil {
+			return nil, err
+		}
+	} else {
+		ent.Raw = make([]byte, zLen)
+		if _, err := io.ReadFull(r.in, ent.Raw); err != nil {
+			return nil, err
+		}
+		if !r.header.checksumMatches(prefix[:overhead], ent.Raw) {
+			ent.err = &EntryParseError{Index: ent.Index, Offset: ent.Offset, Field: "record.checksum", FieldOffset: 4, Msg: "checksum mismatch"}
+		}
+	}
+
+	r.offset += int64(ent.Length)
+	r.index++
+	return ent, nil
+}
+
+// Verify reads every record in f and returns an *EntryParseError for each
+// one that is corrupt: because its checksum doesn't match, it can't be
+// decompressed or parsed, or it is incomplete. Files without checksums are
+// checked only by parsing. A record that is incomplete, usually because its
+// length is damaged, is the last one reported, since the records after it
+// can't be found; everything from its offset to the end of the file must be
+// fetched again. The error is non-nil only if f couldn't be read.
+// If status is non-nil then periodic status updates will be written to it
+// and it will be closed on return.
+func (f EntriesFile) Verify(status chan<- OperationStatus) (corrupt []*EntryParseError, err error) {
+	if status != nil {
+		defer close(status)
+	}
+
+	h, err := f.Header()
+	if err != nil {
+		return nil, err
+	}
+	r, err := f.newRecordReader(h, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		if status != nil && r.index%1000 == 0 {
+			// The total isn't known, so progress is reported in
+			// bytes.
+			status <- OperationStatus{uint64(h.size), uint64(r.offset), uint64(r.end)}
+		}
+
+		ent, err := r.next(false)
+		if err == io.EOF {
+			return corrupt, nil
+		}
+		if parseErr, ok := err.(*EntryParseError); ok {
+			parseErr.Msg += fmt.Sprintf("; the %d bytes from here to the end of the file can't be read", r.end-r.offset)
+			return append(corrupt, parseErr), nil
+		}
+		if err != nil {
+			return corrupt, err
+		}
+
+		if err := ent.Parse(); err != nil {
+			parseErr, ok := err.(*EntryParseError)
+			if !ok {
+				parseErr = &EntryParseError{Index: ent.Index, Offset: ent.Offset, Field: "entry", Msg: err.Error()}
+			}
+			corrupt = append(corrupt, parseErr)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package certificatetransparency
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// modifyTestEntries calls modify with the contents of the entries file with
+// the given name and writes the result back.
+func modifyTestEntries(t *testing.T, fileName string, modify func(data []byte)) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modify(data)
+	if err := ioutil.WriteFile(fileName, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// verifyTestEntries runs Verify on the entries file with the given name.
+func verifyTestEntries(t *testing.T, fileName string) []*EntryParseError {
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	corrupt, err := EntriesFile{file}.Verify(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return corrupt
+}
+
+func TestVerifyDamagedData(t *testing.T) {
+	v1 := NewFileHeader(nil)
+	v1.Version = 1
+	for _, header := range []*FileHeader{NewFileHeader(nil), v1} {
+		fileName := filepath.Join(t.TempDir(), "entries")
+		offsets := writeTestEntries(t, fileName, header, 20)
+		if corrupt := verifyTestEntries(t, fileName); len(corrupt) != 0 {
+			t.Fatalf("version %d: intact file has corrupt records: %v", header.Version, corrupt[0])
+		}
+
+		modifyTestEntries(t, fileName, func(data []byte) {
+			data[offsets[7]+10] ^= 1
+		})
+		corrupt := verifyTestEntries(t, fileName)
+		if len(corrupt) != 1 {
+			t.Fatalf("version %d: %d records reported, want 1", header.Version, len(corrupt))
+		}
+		if corrupt[0].Index != 7 || corrupt[0].Offset != offsets[7] || corrupt[0].Field != "record.checksum" {
+			t.Errorf("version %d: reported %s", header.Version, corrupt[0])
+		}
+	}
+}
+
+func TestVerifyDamagedLength(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "entries")
+	offsets := writeTestEntries(t, fileName, NewFileHeader(nil), 20)
+
+	// A length that is too short is caught by the checksum.
+	modifyTestEntries(t, fileName, func(data []byte) {
+		length := binary.LittleEndian.Uint32(data[offsets[7]:])
+		binary.LittleEndian.PutUint32(data[offsets[7]:], length-1)
+	})
+	corrupt := verifyTestEntries(t, fileName)
+	if len(corrupt) == 0 || corrupt[0].Index != 7 || corrupt[0].Field != "record.checksum" {
+		t.Errorf("short length: reported %v", corrupt)
+	}
+
+	// A length that runs past the end of the file ends the search.
+	fileName = filepath.Join(t.TempDir(), "entries")
+	offsets = writeTestEntries(t, fileName, NewFileHeader(nil), 20)
+	modifyTestEntries(t, fileName, func(data []byte) {
+		length := binary.LittleEndian.Uint32(data[offsets[7]:])
+		binary.LittleEndian.PutUint32(data[offsets[7]:], length|1<<16)
+	})
+	corrupt = verifyTestEntries(t, fileName)
+	if len(corrupt) != 1 || corrupt[0].Index != 7 || !strings.Contains(corrupt[0].Msg, "end of the file") {
+		t.Errorf("long length: reported %v", corrupt)
+	}
+}
@@ -0,0 +1,407 @@
+package certificatetransparency
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// An entries file can have an index file next to it that contains the byte
+// offset of each record as a little-endian uint64. That allows any entry to be
+// found without reading the records before it.
+
+// indexEntrySize is the number of bytes in the index for each entry.
+const indexEntrySize = 8
+
+// IndexFileName returns the name of the file that holds the index for the
+// entries file with the given name.
+func IndexFileName(entriesFileName string) string {
+	return entriesFileName + ".index"
+}
+
+// readOffsets reads the offsets of the entries from start till one less than
+// end from index.
+func readOffsets(index *os.File, start, end uint64) ([]int64, error) {
+	buf := make([]byte, (end-start)*indexEntrySize)
+	if _, err := index.ReadAt(buf, int64(start*indexEntrySize)); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("certificatetransparency: entries %d to %d are not in the index", start, end-1)
+		}
+		return nil, err
+	}
+
+	offsets := make([]int64, 0, end-start)
+	for x := buf; len(x) > 0; x = x[indexEntrySize:] {
+		offsets = append(offsets, int64(binary.LittleEndian.Uint64(x)))
+	}
+	return offsets, nil
+}
+
+// recordLength returns the total length of the record at offset in f.
+func (f EntriesFile) recordLength(h *FileHeader, offset int64) (int64, error) {
+	var buf [4]byte
+	if _, err := f.ReadAt(buf[:], offset); err != nil {
+		return 0, err
+	}
+	return int64(h.recordOverhead()) + int64(binary.LittleEndian.Uint32(buf[:])), nil
+}
+
+// UpdateIndex brings the index file for f up to date and returns the number
+// of entries in f. Only the records after the last indexed one are read, so
+// this is much faster than Count once the index exists. Index entries for
+// records that are no longer complete in f are dropped, and an index that
+// doesn't match f, for example because f has been rewritten, is rebuilt. On
+// return f is positioned after the last record.
+func (f EntriesFile) UpdateIndex() (count uint64, err error) {
+	return f.updateIndex(false)
+}
+
+// updateIndex implements UpdateIndex. If repair is true then an incomplete
+// record at the end of f is truncated rather than being reported as an error.
+func (f EntriesFile) updateIndex(repair bool) (count uint64, err error) {
+	h, err := f.Header()
+	if err != nil {
+		return 0, err
+	}
+	index, err := os.OpenFile(IndexFileName(f.Name()), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if closeErr := index.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	fileSize := info.Size()
+	if info, err = index.Stat(); err != nil {
+		return 0, err
+	}
+	count = uint64(info.Size()) / indexEntrySize
+
+	count, offset, err := f.validIndexEntries(h, index, count, fileSize)
+	if err != nil {
+		return 0, err
+	}
+	if err := index.Truncate(int64(count * indexEntrySize)); err != nil {
+		return 0, err
+	}
+
+	if _, err := index.Seek(int64(count*indexEntrySize), 0); err != nil {
+		return 0, err
+	}
+	out := bufio.NewWriter(index)
+	r, err := f.newRecordReader(h, offset, count)
+	if err != nil {
+		return 0, err
+	}
+	var entry [indexEntrySize]byte
+	for {
+		ent, err := r.next(true)
+		if err == io.EOF {
+			break
+		}
+		if _, ok := err.(*EntryParseError); ok && repair {
+			// Records are only ever appended, so an incomplete
+			// final record is the result of an interrupted write.
+			// A record whose length is damaged also looks
+			// incomplete, but complete records follow it, and then
+			// the file is left for the caller to deal with.
+			followed, followErr := f.recordEndsAt(h, r.offset+1, fileSize)
+			if followErr != nil {
+				return 0, followErr
+			}
+			if followed {
+				return 0, fmt.Errorf("certificatetransparency: %s is corrupt: %s", f.Name(), err)
+			}
+			if err := f.Truncate(r.offset); err != nil {
+				return 0, err
+			}
+			if err := f.Sync(); err != nil {
+				return 0, err
+			}
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		binary.LittleEndian.PutUint64(entry[:], uint64(ent.Offset))
+		if _, err := out.Write(entry[:]); err != nil {
+			return 0, err
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return 0, err
+	}
+
+	if _, err := f.Seek(r.offset, 0); err != nil {
+		return 0, err
+	}
+	return r.index, nil
+}
+
+// indexSamples is the number of pairs of consecutive offsets that
+// validIndexEntries checks.
+const indexSamples = 32
+
+// validIndexEntries returns how many of the first count entries of index can
+// be kept for f, which has header h and is fileSize bytes long, and the
+// offset at which the record after them starts. That is the number of
+// entries whose records are complete in f, which is found by a binary
+// search, or zero if the index doesn't describe f: its first offset must be
+// that of the first record and, for a sample of entries, the record at each
+// offset must end at the next offset.
+func (f EntriesFile) validIndexEntries(h *FileHeader, index *os.File, count uint64, fileSize int64) (n uint64, offset int64, err error) {
+	if count == 0 {
+		return 0, h.size, nil
+	}
+	offsets, err := readOffsets(index, 0, 1)
+	if err != nil {
+		return 0, 0, err
+	}
+	if offsets[0] != h.size {
+		return 0, h.size, nil
+	}
+
+	// end returns the end of the record for the given index entry, or -1
+	// if that record isn't complete in f.
+	end := func(entry uint64) (int64, error) {
+		offsets, err := readOffsets(index, entry, entry+1)
+		if err != nil {
+			return 0, err
+		}
+		if offsets[0] < h.size || offsets[0] >= fileSize {
+			return -1, nil
+		}
+		length, err := f.recordLength(h, offsets[0])
+		if err == io.EOF || err == nil && offsets[0]+length > fileSize {
+			return -1, nil
+		}
+		return offsets[0] + length, err
+	}
+
+	// Records are only appended or truncated, so the complete ones come
+	// first.
+	var searchErr error
+	n = uint64(sort.Search(int(count), func(i int) bool {
+		e, err := end(uint64(i))
+		if err != nil && searchErr == nil {
+			searchErr = err
+		}
+		return e < 0
+	}))
+	if searchErr != nil {
+		return 0, 0, searchErr
+	}
+	if n == 0 {
+		return 0, h.size, nil
+	}
+
+	for i := uint64(0); i <= indexSamples && n > 1; i++ {
+		entry := i * (n - 2) / indexSamples
+		e, err := end(entry)
+		if err != nil {
+			return 0, 0, err
+		}
+		next, err := readOffsets(index, entry+1, entry+2)
+		if err != nil {
+			return 0, 0, err
+		}
+		if e != next[0] {
+			return 0, h.size, nil
+		}
+	}
+	if offset, err = end(n - 1); err != nil {
+		return 0, 0, err
+	}
+	return n, offset, nil
+}
+
+// recordEndsAt returns true if a complete record, with a matching checksum if
+// records have one, starts at or after offset and ends at end. Reading stops
+// at the first such record, so finding that an incomplete record is the last
+// one in the file requires reading the rest of the file.
+func (f EntriesFile) recordEndsAt(h *FileHeader, offset, end int64) (bool, error) {
+	overhead := int64(h.recordOverhead())
+	if end-offset < overhead {
+		return false, nil
+	}
+	in := bufio.NewReaderSize(io.NewSectionReader(f, offset, end-offset-overhead+4), 1<<16)
+
+	// length contains the four bytes before pos as a little-endian uint32.
+	var length uint32
+	for pos := offset; ; pos++ {
+		if pos-offset >= 4 {
+			start := pos - 4
+			if start+overhead+int64(length) == end {
+				prefix := make([]byte, overhead)
+				z := make([]byte, length)
+				if _, err := f.ReadAt(prefix, start); err != nil {
+					return false, err
+				}
+				if _, err := f.ReadAt(z, start+overhead); err != nil {
+					return false, err
+				}
+				if h.checksumMatches(prefix, z) {
+					return true, nil
+				}
+			}
+		}
+		b, err := in.ReadByte()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		length = length>>8 | uint32(b)<<24
+	}
+}
+
+// SeekEntry positions f at the record of the entry with the given index. The
+// index file is used if it covers the entry; otherwise the records before it
+// are skipped from the start of the file.
+func (f EntriesFile) SeekEntry(entry uint64) error {
+	if index, err := os.Open(IndexFileName(f.Name())); err == nil {
+		offset, err := f.indexedOffset(index, entry)
+		index.Close()
+		if err == nil {
+			_, err = f.Seek(offset, 0)
+			return err
+		}
+	}
+
+	h, err := f.Header()
+	if err != nil {
+		return err
+	}
+	r, err := f.newRecordReader(h, 0, 0)
+	if err != nil {
+		return err
+	}
+	for r.index < entry {
+		if _, err := r.next(true); err != nil {
+			return err
+		}
+	}
+	_, err = f.Seek(r.offset, 0)
+	return err
+}
+
+// indexedOffset returns the offset of the record of the entry with the given
+// index using index. If entry is one past the last indexed entry, which is
+// where appending resumes, the offset is the end of the last indexed record.
+func (f EntriesFile) indexedOffset(index *os.File, entry uint64) (int64, error) {
+	offsets, err := readOffsets(index, entry, entry+1)
+	if err == nil {
+		return offsets[0], nil
+	}
+	if entry == 0 {
+		return 0, err
+	}
+
+	if offsets, err = readOffsets(index, entry-1, entry); err != nil {
+		return 0, err
+	}
+	h, err := f.Header()
+	if err != nil {
+		return 0, err
+	}
+	length, err := f.recordLength(h, offsets[0])
+	if err != nil {
+		return 0, err
+	}
+	return offsets[0] + length, nil
+}
+
+// ReadEntry reads and parses the entry with the given index using the index
+// file, which must be up to date (see UpdateIndex). If the entry cannot be
+// parsed then the returned error is an *EntryParseError and the entry's Raw
+// contents are still returned.
+func (f EntriesFile) ReadEntry(index uint64) (*EntryAndPosition, error) {
+	ents, err := f.ReadRange(index, index+1)
+	if len(ents) == 0 {
+		return nil, err
+	}
+	return &ents[0], err
+}
+
+// ReadRange reads and parses the entries from start till one less than end
+// using the index file, which must be up to date (see UpdateIndex). The
+// records are read with a single read and the position of f is unchanged. If
+// an entry cannot be parsed then the entries up to and including it are
+// returned, along with an *EntryParseError.
+func (f EntriesFile) ReadRange(start, end uint64) ([]EntryAndPosition, error) {
+	if start >= end {
+		return nil, nil
+	}
+
+	index, err := os.Open(IndexFileName(f.Name()))
+	if err != nil {
+		return nil, err
+	}
+	offsets, err := readOffsets(index, start, end)
+	index.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := f.Header()
+	if err != nil {
+		return nil, err
+	}
+	last := offsets[len(offsets)-1]
+	lastLen, err := f.recordLength(h, last)
+	if err != nil {
+		return nil, err
+	}
+	if offsets[0] < h.size || last < offsets[0] {
+		return nil, errors.New("certificatetransparency: index does not match the entries file")
+	}
+	codec, err := h.EntryCodec()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, last+lastLen-offsets[0])
+	if _, err := f.ReadAt(data, offsets[0]); err != nil {
+		if err == io.EOF {
+			return nil, errors.New("certificatetransparency: index refers to records beyond the end of the entries file")
+		}
+		return nil, err
+	}
+
+	r := &recordReader{
+		header: h,
+		codec:  codec,
+		in:     bufio.NewReader(bytes.NewReader(data)),
+		offset: offsets[0],
+		end:    offsets[0] + int64(len(data)),
+		index:  start,
+	}
+	ents := make([]EntryAndPosition, 0, len(offsets))
+	for _, offset := range offsets {
+		if r.offset != offset {
+			return ents, errors.New("certificatetransparency: index does not match the entries file")
+		}
+		ent, err := r.next(false)
+		if err != nil {
+			return ents, err
+		}
+		ents = append(ents, *ent)
+		if err := ents[len(ents)-1].Parse(); err != nil {
+			return ents, err
+		}
+	}
+
+	return ents, nil
+}
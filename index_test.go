@@ -0,0 +1,131 @@
+package certificatetransparency
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSeekEntryEnd(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "entries")
+	f, _, err := OpenEntriesFile(fileName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	a, err := f.NewAppender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const count = 10
+	for i := 0; i < count; i++ {
+		if err := a.Append(&RawEntry{LeafInput: []byte{byte(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := f.UpdateIndex(); err != nil || n != count {
+		t.Fatalf("UpdateIndex returned %d, %v", n, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := f.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the first record's length so that scanning from the start of
+	// the file would fail.
+	if _, err := f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, h.Size()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.SeekEntry(count); err != nil {
+		t.Fatal(err)
+	}
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != info.Size() {
+		t.Errorf("SeekEntry(%d) moved to %d, want the end of the file at %d", count, offset, info.Size())
+	}
+}
+
+// checkIndex checks that the entries file with the given name has an index
+// that matches offsets, after UpdateIndex or OpenEntriesFile.
+func checkIndex(t *testing.T, name, fileName string, offsets []int64) {
+	f, count, err := OpenEntriesFile(fileName, nil)
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	defer f.Close()
+	if count != uint64(len(offsets)) {
+		t.Errorf("%s: %d entries, want %d", name, count, len(offsets))
+	}
+	data, err := ioutil.ReadFile(IndexFileName(fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != len(offsets)*indexEntrySize {
+		t.Fatalf("%s: index has %d bytes, want %d", name, len(data), len(offsets)*indexEntrySize)
+	}
+	for i, offset := range offsets {
+		if got := int64(binary.LittleEndian.Uint64(data[i*indexEntrySize:])); got != offset {
+			t.Fatalf("%s: index entry %d is %d, want %d", name, i, got, offset)
+		}
+	}
+}
+
+func TestUpdateIndexStale(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "entries")
+	offsets := writeTestEntries(t, fileName, nil, 100)
+	checkIndex(t, "new index", fileName, offsets)
+	staleIndex, err := ioutil.ReadFile(IndexFileName(fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A truncated file keeps the index entries of its complete records.
+	if err := os.Truncate(fileName, offsets[60]+3); err != nil {
+		t.Fatal(err)
+	}
+	checkIndex(t, "truncated", fileName, offsets[:60])
+
+	// A file rewritten with larger records, so that it is longer than the
+	// old one, has the same first offset but the index must be rebuilt.
+	file, err := os.Create(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := writeEntry(file, &RawEntry{LeafInput: testLeaf(uint64(i)), ExtraData: make([]byte, 100)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rewritten := testEntryOffsets(t, EntriesFile{file})
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(IndexFileName(fileName), staleIndex, 0666); err != nil {
+		t.Fatal(err)
+	}
+	checkIndex(t, "rewritten", fileName, rewritten)
+
+	// An index whose first offset isn't that of the first record is
+	// rebuilt.
+	offsets = writeTestEntries(t, fileName, NewFileHeader(nil), 100)
+	if err := ioutil.WriteFile(IndexFileName(fileName), staleIndex, 0666); err != nil {
+		t.Fatal(err)
+	}
+	checkIndex(t, "other header", fileName, offsets)
+}
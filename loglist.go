@@ -0,0 +1,395 @@
+package certificatetransparency
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// LogListURL is the location of the log list maintained by Google for
+// Chrome, in the v3 format.
+const LogListURL = "https://www.gstatic.com/ct/log_list/v3/log_list.json"
+
+// LogListSignatureURL is the location of the detached signature over the log
+// list at LogListURL.
+const LogListSignatureURL = "https://www.gstatic.com/ct/log_list/v3/log_list.sig"
+
+// LogListKeyURL is the location of the public key that signs the log list at
+// LogListURL. It should be fetched once and kept locally, rather than trusted
+// afresh with each copy of the list.
+const LogListKeyURL = "https://www.gstatic.com/ct/log_list/v3/log_list_pubkey.pem"
+
+// maxLogListSize is the largest log list that will be accepted.
+const maxLogListSize = 16 << 20
+
+// LogState is the state of a log in the log list. See
+// https://googlechrome.github.io/CertificateTransparency/log_states.html
+type LogState string
+
+const (
+	LogStatePending   LogState = "pending"
+	LogStateQualified LogState = "qualified"
+	LogStateUsable    LogState = "usable"
+	LogStateReadOnly  LogState = "readonly"
+	LogStateRetired   LogState = "retired"
+	LogStateRejected  LogState = "rejected"
+)
+
+type LogOperator struct {
+	Name string `json:"name"`
+	Id   uint64 `json:"id"`
+}
+
+type LogData struct {
+	Desc         string   `json:"description"`         // "description": "Google 'Pilot' log",
+	Key          string   `json:"key"`                 // "key": "MFkwEwYHKoZIzj0C....o==",
+	URL          string   `json:"url"`                 // "url": "ct.googleapis.com/pilot", without the scheme
+	MMD          uint64   `json:"maximum_merge_delay"` // "mmd": 86400,
+	OperatorId   []uint64 `json:"operated_by"`         // Index of the operator in LogList.OperatorList
+	OperatorName string
+	PublicLog    *Log
+	SafeFileName string
+	// ID contains the log's LogID, as given in the log list.
+	ID LogID
+	// KeyErr, if not nil, explains why PublicLog is nil: the key couldn't
+	// be parsed or the log ID computed from it doesn't match ID.
+	KeyErr error `json:"-"`
+	// State contains the state of the log, or the empty string if the log
+	// list doesn't say.
+	State LogState
+	// StateTime contains the time that the log entered State.
+	StateTime time.Time
+	// TemporalStart and TemporalEnd contain the range of certificate
+	// expiry times, from TemporalStart inclusive to TemporalEnd exclusive,
+	// accepted by a temporally sharded log. Both are zero if the log isn't
+	// sharded.
+	TemporalStart, TemporalEnd time.Time
+}
+
+// InTemporalInterval returns whether a certificate that expires at t may be
+// logged in the log. This is always true for logs that aren't sharded.
+func (log *LogData) InTemporalInterval(t time.Time) bool {
+	if log.TemporalStart.IsZero() && log.TemporalEnd.IsZero() {
+		return true
+	}
+	return !t.Before(log.TemporalStart) && t.Before(log.TemporalEnd)
+}
+
+type LogList struct {
+	OperatorList []LogOperator `json:"operators"`
+	Logs         []LogData     `json:"logs"`
+	OperatorMap  map[uint64]string
+
+	byID  map[LogID]*LogData
+	byURL map[string]*LogData
+}
+
+// trimLogURL removes the scheme and any trailing slash from a log's URL.
+func trimLogURL(url string) string {
+	url = strings.TrimSuffix(url, "/")
+	url = strings.TrimPrefix(url, "https://")
+	return strings.TrimPrefix(url, "http://")
+}
+
+// LogByID returns the log with the given LogID, or nil if there isn't one.
+func (list *LogList) LogByID(id LogID) *LogData {
+	return list.byID[id]
+}
+
+// LogByURL returns the log with the given URL, or nil if there isn't one. The
+// scheme and any trailing slash in url are ignored.
+func (list *LogList) LogByURL(url string) *LogData {
+	return list.byURL[trimLogURL(url)]
+}
+
+// LogsWithState returns the logs that are in one of the given states.
+func (list *LogList) LogsWithState(states ...LogState) []LogData {
+	var ret []LogData
+	for _, log := range list.Logs {
+		for _, state := range states {
+			if log.State == state {
+				ret = append(ret, log)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// logListV3 is the JSON structure of a v3 log list. See
+// https://www.gstatic.com/ct/log_list/v3/log_list_schema.json
+type logListV3 struct {
+	Version          string       `json:"version"`
+	LogListTimestamp time.Time    `json:"log_list_timestamp"`
+	Operators        []operatorV3 `json:"operators"`
+}
+
+type operatorV3 struct {
+	Name  string   `json:"name"`
+	Email []string `json:"email"`
+	Logs  []logV3  `json:"logs"`
+	// TiledLogs contains logs that implement the static CT API.
+	TiledLogs []tiledLogV3 `json:"tiled_logs"`
+}
+
+type logV3 struct {
+	Description      string              `json:"description"`
+	LogID            []byte              `json:"log_id"`
+	Key              []byte              `json:"key"`
+	URL              string              `json:"url"`
+	MMD              uint64              `json:"mmd"`
+	State            map[string]stateV3  `json:"state"`
+	TemporalInterval *temporalIntervalV3 `json:"temporal_interval"`
+	LogType          string              `json:"log_type"`
+}
+
+type tiledLogV3 struct {
+	logV3
+	SubmissionURL string `json:"submission_url"`
+	MonitoringURL string `json:"monitoring_url"`
+}
+
+type stateV3 struct {
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type temporalIntervalV3 struct {
+	StartInclusive time.Time `json:"start_inclusive"`
+	EndExclusive   time.Time `json:"end_exclusive"`
+}
+
+var safeNameRe = regexp.MustCompile("[^0-9A-Za-z\\.]")
+
+// LoadLogList parses a log list in the v3 JSON format from r.
+func LoadLogList(r io.Reader) (*LogList, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxLogListSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxLogListSize {
+		return nil, errors.New("certificatetransparency: log list too large")
+	}
+	return parseLogList(data)
+}
+
+// LoadLogListFile parses a log list in the v3 JSON format from the named
+// file.
+func LoadLogListFile(fileName string) (*LogList, error) {
+	in, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	return LoadLogList(in)
+}
+
+// LoadLogListURL fetches and parses a log list in the v3 JSON format. If
+// client is nil, http.DefaultClient is used.
+func LoadLogListURL(ctx context.Context, client *http.Client, url string) (*LogList, error) {
+	data, err := fetchURL(ctx, client, url)
+	if err != nil {
+		return nil, err
+	}
+	return parseLogList(data)
+}
+
+// fetchURL fetches url, which must be at most maxLogListSize bytes long.
+func fetchURL(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, &ServerError{URL: url, StatusCode: resp.StatusCode}
+	}
+	if resp.ContentLength > maxLogListSize {
+		return nil, errors.New("certificatetransparency: body too large")
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxLogListSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxLogListSize {
+		return nil, errors.New("certificatetransparency: body too large")
+	}
+	return data, nil
+}
+
+// ParseLogListKey parses a PEM encoded public key that signs a log list.
+func ParseLogListKey(pemPublicKey []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(pemPublicKey)
+	if block == nil {
+		return nil, errors.New("certificatetransparency: no PEM block found in log list key")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// VerifyLogListSignature checks that sig is a valid signature by key over the
+// log list in data. Log lists are signed with SHA-256 and either RSA
+// PKCS#1 v1.5 or ECDSA.
+func VerifyLogListSignature(key crypto.PublicKey, data, sig []byte) error {
+	if err := verifySignature(key, data, sig); err != nil {
+		return errors.New("certificatetransparency: log list signature verification failed: " + err.Error())
+	}
+	return nil
+}
+
+// LoadSignedLogList parses a log list from r after checking that sig is a
+// valid signature over it by key.
+func LoadSignedLogList(r io.Reader, sig []byte, key crypto.PublicKey) (*LogList, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxLogListSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxLogListSize {
+		return nil, errors.New("certificatetransparency: log list too large")
+	}
+	if err := VerifyLogListSignature(key, data, sig); err != nil {
+		return nil, err
+	}
+	return parseLogList(data)
+}
+
+// LoadSignedLogListFile parses a log list from the named file after checking
+// the signature in sigFileName.
+func LoadSignedLogListFile(fileName, sigFileName string, key crypto.PublicKey) (*LogList, error) {
+	sig, err := ioutil.ReadFile(sigFileName)
+	if err != nil {
+		return nil, err
+	}
+	in, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	return LoadSignedLogList(in, sig, key)
+}
+
+// LoadSignedLogListURL fetches a log list and its signature and parses the
+// list once the signature has been checked. If client is nil,
+// http.DefaultClient is used.
+func LoadSignedLogListURL(ctx context.Context, client *http.Client, url, sigURL string, key crypto.PublicKey) (*LogList, error) {
+	data, err := fetchURL(ctx, client, url)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := fetchURL(ctx, client, sigURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := VerifyLogListSignature(key, data, sig); err != nil {
+		return nil, err
+	}
+	return parseLogList(data)
+}
+
+// GetAllLogsList fetches the log list from LogListURL. The list is not
+// authenticated beyond HTTPS; use GetSignedLogsList to check its signature.
+func GetAllLogsList() (*LogList, error) {
+	return LoadLogListURL(context.Background(), nil, LogListURL)
+}
+
+// GetSignedLogsList fetches the log list from LogListURL and checks the
+// signature from LogListSignatureURL against key, which is typically the
+// key published at LogListKeyURL.
+func GetSignedLogsList(key crypto.PublicKey) (*LogList, error) {
+	return LoadSignedLogListURL(context.Background(), nil, LogListURL, LogListSignatureURL, key)
+}
+
+func parseLogList(data []byte) (*LogList, error) {
+	var list logListV3
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+
+	logs := new(LogList)
+	logs.OperatorMap = make(map[uint64]string)
+	for i, operator := range list.Operators {
+		id := uint64(i)
+		logs.OperatorList = append(logs.OperatorList, LogOperator{operator.Name, id})
+		logs.OperatorMap[id] = operator.Name
+
+		for _, log := range operator.Logs {
+			logs.Logs = append(logs.Logs, newLogData(log, log.URL, operator.Name, id))
+		}
+		for _, log := range operator.TiledLogs {
+			data := newLogData(log.logV3, log.SubmissionURL, operator.Name, id)
+			if data.PublicLog != nil {
+				data.PublicLog.TileRoot = strings.TrimSuffix(log.MonitoringURL, "/")
+			}
+			logs.Logs = append(logs.Logs, data)
+		}
+	}
+
+	logs.byID = make(map[LogID]*LogData)
+	logs.byURL = make(map[string]*LogData)
+	for i := range logs.Logs {
+		logs.byID[logs.Logs[i].ID] = &logs.Logs[i]
+		logs.byURL[logs.Logs[i].URL] = &logs.Logs[i]
+	}
+
+	return logs, nil
+}
+
+// newLogData converts a log from a v3 log list, whose URL (or submission URL
+// for a tiled log) is logURL.
+func newLogData(log logV3, logURL, operatorName string, operatorID uint64) LogData {
+	const BEGIN = `-----BEGIN PUBLIC KEY-----
+`
+	const END = `
+-----END PUBLIC KEY-----`
+
+	url := trimLogURL(logURL)
+	data := LogData{
+		Desc:         log.Description,
+		Key:          base64.StdEncoding.EncodeToString(log.Key),
+		URL:          url,
+		MMD:          log.MMD,
+		OperatorId:   []uint64{operatorID},
+		OperatorName: operatorName,
+		SafeFileName: safeNameRe.ReplaceAllString(url, "_") + ".log",
+	}
+	for state, info := range log.State {
+		data.State = LogState(state)
+		data.StateTime = info.Timestamp
+	}
+	if log.TemporalInterval != nil {
+		data.TemporalStart = log.TemporalInterval.StartInclusive
+		data.TemporalEnd = log.TemporalInterval.EndExclusive
+	}
+	data.PublicLog, data.KeyErr = NewLog(strings.TrimSuffix(logURL, "/"), BEGIN+data.Key+END)
+	switch {
+	case data.PublicLog == nil:
+		copy(data.ID[:], log.LogID)
+	case len(log.LogID) == 0:
+		data.ID = data.PublicLog.ID()
+	default:
+		copy(data.ID[:], log.LogID)
+		if id := data.PublicLog.ID(); !bytes.Equal(log.LogID, id[:]) {
+			data.PublicLog = nil
+			data.KeyErr = fmt.Errorf("certificatetransparency: log list gives log ID %s for %s but its key has ID %s", base64.StdEncoding.EncodeToString(log.LogID), url, id)
+		}
+	}
+	return data
+}
@@ -0,0 +1,153 @@
+package certificatetransparency
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestLogListIDs(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spki, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := sha256.Sum256(spki)
+	wrongID := sha256.Sum256([]byte("wrong"))
+
+	type log struct {
+		LogID []byte `json:"log_id"`
+		Key   []byte `json:"key"`
+		URL   string `json:"url"`
+	}
+	list := map[string]interface{}{
+		"operators": []interface{}{
+			map[string]interface{}{
+				"name": "Operator",
+				"logs": []log{
+					{id[:], spki, "https://good.example/"},
+					{wrongID[:], spki, "https://mismatch.example/"},
+					{wrongID[:], []byte("not a key"), "https://badkey.example/"},
+					{nil, spki, "https://noid.example/"},
+				},
+			},
+		},
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs, err := LoadLogList(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url    string
+		id     [32]byte
+		usable bool
+	}{
+		{"good.example", id, true},
+		{"mismatch.example", wrongID, false},
+		{"badkey.example", wrongID, false},
+		{"noid.example", id, true},
+	}
+	for _, test := range tests {
+		data := logs.LogByURL(test.url)
+		if data == nil {
+			t.Errorf("%s: not found", test.url)
+			continue
+		}
+		if data.ID != LogID(test.id) {
+			t.Errorf("%s: ID is %s", test.url, data.ID)
+		}
+		if usable := data.PublicLog != nil; usable != test.usable {
+			t.Errorf("%s: usable is %t, want %t", test.url, usable, test.usable)
+		}
+		if (data.KeyErr == nil) != test.usable {
+			t.Errorf("%s: KeyErr is %v", test.url, data.KeyErr)
+		}
+	}
+}
+
+func TestLoadSignedLogList(t *testing.T) {
+	logKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spki, err := x509.MarshalPKIXPublicKey(&logKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(`{"version":"3.0","operators":[{"name":"Operator","logs":[{"key":"` +
+		base64.StdEncoding.EncodeToString(spki) + `","url":"https://log.example/"}]}]}`)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(data)
+	for _, signer := range []crypto.Signer{rsaKey, ecdsaKey} {
+		sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		spki, err := x509.MarshalPKIXPublicKey(signer.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := ParseLogListKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: spki}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dir := t.TempDir()
+		fileName, sigFileName := filepath.Join(dir, "log_list.json"), filepath.Join(dir, "log_list.sig")
+		if err := ioutil.WriteFile(fileName, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(sigFileName, sig, 0644); err != nil {
+			t.Fatal(err)
+		}
+		list, err := LoadSignedLogListFile(fileName, sigFileName, key)
+		if err != nil {
+			t.Fatalf("%T: %s", key, err)
+		}
+		if log := list.LogByURL("log.example"); log == nil || log.PublicLog == nil {
+			t.Errorf("%T: log not found in signed list", key)
+		}
+
+		for i := range data {
+			modified := append([]byte(nil), data...)
+			modified[i] ^= 1
+			if _, err := LoadSignedLogList(bytes.NewReader(modified), sig, key); err == nil {
+				t.Fatalf("%T: list with byte %d changed was accepted", key, i)
+			}
+		}
+		for i := range sig {
+			modified := append([]byte(nil), sig...)
+			modified[i] ^= 1
+			if _, err := LoadSignedLogList(bytes.NewReader(data), modified, key); err == nil {
+				t.Fatalf("%T: signature with byte %d changed was accepted", key, i)
+			}
+		}
+	}
+}
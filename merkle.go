@@ -0,0 +1,225 @@
+package certificatetransparency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// LeafHash returns the Merkle tree hash of a log entry's leaf input. See
+// https://tools.ietf.org/html/rfc6962#section-2.1
+func LeafHash(leafInput []byte) [sha256.Size]byte {
+	var digest [sha256.Size]byte
+	h := sha256.New()
+	h.Write(exteriorNodePrefix)
+	h.Write(leafInput)
+	h.Sum(digest[:0])
+	return digest
+}
+
+// hashChildren returns the hash of an interior node with the given children.
+func hashChildren(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write(interiorNodePrefix)
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// AuditProof contains a Merkle audit path for a single leaf.
+type AuditProof struct {
+	// LeafIndex is the index of the leaf in the log.
+	LeafIndex uint64 `json:"leaf_index"`
+	// AuditPath contains the sibling hashes from the leaf up to the root.
+	AuditPath [][]byte `json:"audit_path"`
+	// TreeSize is the size of the tree that the proof is relative to.
+	TreeSize uint64 `json:"-"`
+}
+
+// GetProofByHash fetches an audit proof for the leaf with the given Merkle
+// leaf hash in the tree of size treeSize. The proof is not verified; use
+// VerifyAuditProof for that.
+func (log *Log) GetProofByHash(ctx context.Context, leafHash []byte, treeSize uint64) (*AuditProof, error) {
+	// See https://tools.ietf.org/html/rfc6962#section-4.5
+	if len(leafHash) != sha256.Size {
+		return nil, errors.New("certificatetransparency: leaf hash has wrong length")
+	}
+
+	path := fmt.Sprintf("/ct/v1/get-proof-by-hash?hash=%s&tree_size=%d", url.QueryEscape(base64.StdEncoding.EncodeToString(leafHash)), treeSize)
+	proof := new(AuditProof)
+	if err := log.getJSON(ctx, path, 1<<16, proof); err != nil {
+		return nil, err
+	}
+	proof.TreeSize = treeSize
+
+	return proof, nil
+}
+
+// VerifyAuditProof checks that proof shows that the leaf with the given leaf
+// hash is included in the tree described by sth.
+func VerifyAuditProof(leafHash []byte, proof *AuditProof, sth *SignedTreeHead) error {
+	if proof.TreeSize != sth.Size {
+		return errors.New("certificatetransparency: audit proof is for a different tree size")
+	}
+	return verifyAuditPath(leafHash, proof.LeafIndex, sth.Size, proof.AuditPath, sth.Hash)
+}
+
+// verifyAuditPath implements the audit path verification algorithm from
+// https://tools.ietf.org/html/rfc9162#section-2.1.3.2
+func verifyAuditPath(leafHash []byte, index, treeSize uint64, path [][]byte, root []byte) error {
+	if index >= treeSize {
+		return errors.New("certificatetransparency: leaf index beyond tree size")
+	}
+
+	fn := index
+	sn := treeSize - 1
+	r := leafHash
+	for _, p := range path {
+		if len(p) != sha256.Size {
+			return errors.New("certificatetransparency: audit path contains hash of wrong length")
+		}
+		if sn == 0 {
+			return errors.New("certificatetransparency: audit path too long")
+		}
+
+		if fn&1 == 1 || fn == sn {
+			r = hashChildren(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = hashChildren(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 {
+		return errors.New("certificatetransparency: audit path too short")
+	}
+	if !bytes.Equal(r, root) {
+		return errors.New("certificatetransparency: audit path does not match tree hash")
+	}
+
+	return nil
+}
+
+type consistencyProof struct {
+	Consistency [][]byte `json:"consistency"`
+}
+
+// GetSTHConsistency fetches a consistency proof between the trees of sizes
+// first and second. The proof is not verified; use VerifyConsistencyProof for
+// that.
+func (log *Log) GetSTHConsistency(ctx context.Context, first, second uint64) ([][]byte, error) {
+	if len(log.TileRoot) > 0 {
+		// Tiled logs don't serve proofs, so the proof is computed
+		// from the tiles of the last checkpoint.
+		r, err := log.currentTiles()
+		if err != nil {
+			return nil, err
+		}
+		if second != r.head.Size {
+			return nil, errors.New("certificatetransparency: consistency proofs from a tiled log must end at the last checkpoint")
+		}
+		return r.consistencyProof(ctx, first)
+	}
+
+	// See https://tools.ietf.org/html/rfc6962#section-4.4
+	var proof consistencyProof
+	if err := log.getJSON(ctx, fmt.Sprintf("/ct/v1/get-sth-consistency?first=%d&second=%d", first, second), 1<<16, &proof); err != nil {
+		return nil, err
+	}
+
+	return proof.Consistency, nil
+}
+
+// VerifyConsistencyProof checks that proof shows that the tree described by
+// newer is an append-only extension of the tree described by older.
+func VerifyConsistencyProof(older, newer *SignedTreeHead, proof [][]byte) error {
+	return verifyConsistency(older.Size, newer.Size, older.Hash, newer.Hash, proof)
+}
+
+// verifyConsistency implements the consistency proof verification algorithm
+// from https://tools.ietf.org/html/rfc9162#section-2.1.4.2
+func verifyConsistency(first, second uint64, firstHash, secondHash []byte, proof [][]byte) error {
+	for _, p := range proof {
+		if len(p) != sha256.Size {
+			return errors.New("certificatetransparency: consistency proof contains hash of wrong length")
+		}
+	}
+
+	switch {
+	case first > second:
+		return errors.New("certificatetransparency: older tree is larger than newer tree")
+	case first == second:
+		if len(proof) != 0 {
+			return errors.New("certificatetransparency: consistency proof for equal trees is not empty")
+		}
+		if !bytes.Equal(firstHash, secondHash) {
+			return errors.New("certificatetransparency: tree hashes differ for trees of equal size")
+		}
+		return nil
+	case first == 0:
+		// Every tree is consistent with the empty tree.
+		if len(proof) != 0 {
+			return errors.New("certificatetransparency: consistency proof from empty tree is not empty")
+		}
+		return nil
+	}
+
+	if len(proof) == 0 {
+		return errors.New("certificatetransparency: consistency proof is empty")
+	}
+
+	if first&(first-1) == 0 {
+		// The older tree is a complete subtree and so its hash is
+		// implicitly the first element of the proof.
+		proof = append([][]byte{firstHash}, proof...)
+	}
+
+	fn := first - 1
+	sn := second - 1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+
+	fr := proof[0]
+	sr := proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return errors.New("certificatetransparency: consistency proof too long")
+		}
+
+		if fn&1 == 1 || fn == sn {
+			fr = hashChildren(c, fr)
+			sr = hashChildren(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = hashChildren(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 {
+		return errors.New("certificatetransparency: consistency proof too short")
+	}
+	if !bytes.Equal(fr, firstHash) {
+		return errors.New("certificatetransparency: consistency proof does not match older tree hash")
+	}
+	if !bytes.Equal(sr, secondHash) {
+		return errors.New("certificatetransparency: consistency proof does not match newer tree hash")
+	}
+
+	return nil
+}
@@ -0,0 +1,308 @@
+package certificatetransparency
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// referenceLeaves are the leaf inputs of the tree used for the reference test
+// vectors in the RFC 6962 implementations.
+var referenceLeaves = [][]byte{
+	{},
+	{0x00},
+	{0x10},
+	{0x20, 0x21},
+	{0x30, 0x31},
+	{0x40, 0x41, 0x42, 0x43},
+	{0x50, 0x51, 0x52, 0x53, 0x54, 0x55, 0x56, 0x57},
+	{0x60, 0x61, 0x62, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69, 0x6a, 0x6b, 0x6c, 0x6d, 0x6e, 0x6f},
+}
+
+// referenceRoots contains the root hashes of the trees of the first one to
+// eight referenceLeaves.
+var referenceRoots = []string{
+	"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+	"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+	"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+	"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+	"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+	"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+}
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func decodeHashes(hexHashes ...string) [][]byte {
+	hashes := make([][]byte, 0, len(hexHashes))
+	for _, h := range hexHashes {
+		hashes = append(hashes, mustDecodeHex(h))
+	}
+	return hashes
+}
+
+// splitPoint returns the largest power of two less than n, which must be at
+// least two.
+func splitPoint(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// referenceHash computes MTH(leaves) as defined in
+// https://tools.ietf.org/html/rfc6962#section-2.1
+func referenceHash(leaves [][]byte) []byte {
+	if len(leaves) == 1 {
+		h := LeafHash(leaves[0])
+		return h[:]
+	}
+	k := splitPoint(len(leaves))
+	return hashChildren(referenceHash(leaves[:k]), referenceHash(leaves[k:]))
+}
+
+// referencePath computes PATH(m, leaves) as defined in
+// https://tools.ietf.org/html/rfc6962#section-2.1.1
+func referencePath(m int, leaves [][]byte) [][]byte {
+	if len(leaves) == 1 {
+		return nil
+	}
+	k := splitPoint(len(leaves))
+	if m < k {
+		return append(referencePath(m, leaves[:k]), referenceHash(leaves[k:]))
+	}
+	return append(referencePath(m-k, leaves[k:]), referenceHash(leaves[:k]))
+}
+
+// referenceProof computes PROOF(m, leaves) as defined in
+// https://tools.ietf.org/html/rfc6962#section-2.1.2
+func referenceProof(m int, leaves [][]byte) [][]byte {
+	return referenceSubproof(m, leaves, true)
+}
+
+func referenceSubproof(m int, leaves [][]byte, complete bool) [][]byte {
+	n := len(leaves)
+	if m == n {
+		if complete {
+			return nil
+		}
+		return [][]byte{referenceHash(leaves)}
+	}
+	k := splitPoint(n)
+	if m <= k {
+		return append(referenceSubproof(m, leaves[:k], complete), referenceHash(leaves[k:]))
+	}
+	return append(referenceSubproof(m-k, leaves[k:], false), referenceHash(leaves[:k]))
+}
+
+// withHash returns a copy of hashes with the element at i replaced by h.
+func withHash(hashes [][]byte, i int, h []byte) [][]byte {
+	out := append([][]byte(nil), hashes...)
+	out[i] = h
+	return out
+}
+
+// flipped returns a copy of h with one bit changed.
+func flipped(h []byte) []byte {
+	out := append([]byte(nil), h...)
+	out[len(out)-1] ^= 1
+	return out
+}
+
+func TestReferenceRoots(t *testing.T) {
+	for n := 1; n <= len(referenceLeaves); n++ {
+		if got := hex.EncodeToString(referenceHash(referenceLeaves[:n])); got != referenceRoots[n-1] {
+			t.Errorf("root of tree of size %d is %s, want %s", n, got, referenceRoots[n-1])
+		}
+	}
+}
+
+func TestVerifyAuditPath(t *testing.T) {
+	// Inclusion proofs from the RFC 6962 reference implementation's tests.
+	tests := []struct {
+		index, treeSize uint64
+		path            [][]byte
+	}{
+		{0, 1, nil},
+		{0, 8, decodeHashes(
+			"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4")},
+		{5, 8, decodeHashes(
+			"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+			"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+			"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7")},
+		{2, 3, decodeHashes(
+			"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125")},
+		{1, 5, decodeHashes(
+			"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b")},
+	}
+	for _, test := range tests {
+		leaf := LeafHash(referenceLeaves[test.index])
+		root := mustDecodeHex(referenceRoots[test.treeSize-1])
+		if err := verifyAuditPath(leaf[:], test.index, test.treeSize, test.path, root); err != nil {
+			t.Errorf("leaf %d in tree of size %d: %s", test.index, test.treeSize, err)
+		}
+	}
+
+	// Every path in every tree of the reference leaves must verify, and
+	// every corruption of it must not.
+	for n := 1; n <= len(referenceLeaves); n++ {
+		treeSize := uint64(n)
+		root := mustDecodeHex(referenceRoots[n-1])
+		for m := 0; m < n; m++ {
+			index := uint64(m)
+			leaf := LeafHash(referenceLeaves[m])
+			path := referencePath(m, referenceLeaves[:n])
+			if err := verifyAuditPath(leaf[:], index, treeSize, path, root); err != nil {
+				t.Errorf("leaf %d in tree of size %d: %s", m, n, err)
+			}
+
+			bad := []badAuditPath{
+				{"wrong leaf", flipped(leaf[:]), index, treeSize, path, root},
+				{"wrong root", leaf[:], index, treeSize, path, flipped(root)},
+				{"empty root", leaf[:], index, treeSize, path, nil},
+				{"wrong index", leaf[:], index ^ 1, treeSize, path, root},
+				{"index beyond tree", leaf[:], treeSize, treeSize, path, root},
+				{"extra hash", leaf[:], index, treeSize, append(append([][]byte(nil), path...), root), root},
+			}
+			if len(path) > 0 {
+				bad = append(bad,
+					badAuditPath{"missing hash", leaf[:], index, treeSize, path[:len(path)-1], root},
+					badAuditPath{"short hash", leaf[:], index, treeSize, withHash(path, 0, path[0][:31]), root},
+					badAuditPath{"long hash", leaf[:], index, treeSize, withHash(path, 0, append(append([]byte(nil), path[0]...), 0)), root})
+			}
+			for i := range path {
+				bad = append(bad, badAuditPath{"wrong hash", leaf[:], index, treeSize, withHash(path, i, flipped(path[i])), root})
+			}
+			for _, b := range bad {
+				if err := verifyAuditPath(b.leaf, b.index, b.treeSize, b.path, b.root); err == nil {
+					t.Errorf("leaf %d in tree of size %d: %s was accepted", m, n, b.name)
+				}
+			}
+		}
+	}
+}
+
+// badAuditPath is an audit path verification that must fail.
+type badAuditPath struct {
+	name            string
+	leaf            []byte
+	index, treeSize uint64
+	path            [][]byte
+	root            []byte
+}
+
+func TestVerifyAuditProofTreeSize(t *testing.T) {
+	leaf := LeafHash(referenceLeaves[0])
+	sth := &SignedTreeHead{Size: 8, Hash: mustDecodeHex(referenceRoots[7])}
+	proof := &AuditProof{LeafIndex: 0, TreeSize: 8, AuditPath: referencePath(0, referenceLeaves)}
+	if err := VerifyAuditProof(leaf[:], proof, sth); err != nil {
+		t.Fatal(err)
+	}
+	proof.TreeSize = 7
+	if err := VerifyAuditProof(leaf[:], proof, sth); err == nil {
+		t.Fatal("proof for a different tree size was accepted")
+	}
+}
+
+func TestVerifyConsistency(t *testing.T) {
+	// Consistency proofs from the RFC 6962 reference implementation's
+	// tests.
+	tests := []struct {
+		first, second uint64
+		proof         [][]byte
+	}{
+		{1, 1, nil},
+		{1, 8, decodeHashes(
+			"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4")},
+		{6, 8, decodeHashes(
+			"0ebc5d3437fbe2db158b9f126a1d118e308181031d0a949f8dededebc558ef6a",
+			"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+			"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7")},
+		{2, 5, decodeHashes(
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b")},
+	}
+	for _, test := range tests {
+		firstHash := mustDecodeHex(referenceRoots[test.first-1])
+		secondHash := mustDecodeHex(referenceRoots[test.second-1])
+		if err := verifyConsistency(test.first, test.second, firstHash, secondHash, test.proof); err != nil {
+			t.Errorf("trees of sizes %d and %d: %s", test.first, test.second, err)
+		}
+	}
+
+	// Every proof between trees of the reference leaves must verify, and
+	// every corruption of it must not.
+	for n := 1; n <= len(referenceLeaves); n++ {
+		second := uint64(n)
+		secondHash := mustDecodeHex(referenceRoots[n-1])
+		for m := 1; m <= n; m++ {
+			first := uint64(m)
+			firstHash := mustDecodeHex(referenceRoots[m-1])
+			proof := referenceProof(m, referenceLeaves[:n])
+			if err := verifyConsistency(first, second, firstHash, secondHash, proof); err != nil {
+				t.Errorf("trees of sizes %d and %d: %s", m, n, err)
+			}
+
+			bad := []badConsistencyProof{
+				{"wrong older hash", first, second, flipped(firstHash), secondHash, proof},
+				{"wrong newer hash", first, second, firstHash, flipped(secondHash), proof},
+				{"extra hash", first, second, firstHash, secondHash, append(append([][]byte(nil), proof...), secondHash)},
+			}
+			if m < n {
+				bad = append(bad,
+					badConsistencyProof{"swapped sizes", second, first, secondHash, firstHash, proof},
+					badConsistencyProof{"empty proof", first, second, firstHash, secondHash, nil},
+					badConsistencyProof{"missing hash", first, second, firstHash, secondHash, proof[:len(proof)-1]},
+					badConsistencyProof{"short hash", first, second, firstHash, secondHash, withHash(proof, 0, proof[0][:31])},
+					badConsistencyProof{"long hash", first, second, firstHash, secondHash, withHash(proof, 0, append(append([]byte(nil), proof[0]...), 0))},
+					badConsistencyProof{"empty older tree", 0, second, nil, secondHash, proof})
+			}
+			for i := range proof {
+				bad = append(bad, badConsistencyProof{"wrong hash", first, second, firstHash, secondHash, withHash(proof, i, flipped(proof[i]))})
+			}
+			for _, b := range bad {
+				if err := verifyConsistency(b.first, b.second, b.firstHash, b.secondHash, b.proof); err == nil {
+					t.Errorf("trees of sizes %d and %d: %s was accepted", m, n, b.name)
+				}
+			}
+		}
+	}
+
+	// Every tree is consistent with the empty tree, given an empty proof.
+	if err := verifyConsistency(0, 8, nil, mustDecodeHex(referenceRoots[7]), nil); err != nil {
+		t.Errorf("empty tree: %s", err)
+	}
+}
+
+// badConsistencyProof is a consistency proof verification that must fail.
+type badConsistencyProof struct {
+	name                  string
+	first, second         uint64
+	firstHash, secondHash []byte
+	proof                 [][]byte
+}
+
+func TestVerifyConsistencyProof(t *testing.T) {
+	older := &SignedTreeHead{Size: 3, Hash: mustDecodeHex(referenceRoots[2])}
+	newer := &SignedTreeHead{Size: 7, Hash: mustDecodeHex(referenceRoots[6])}
+	proof := referenceProof(3, referenceLeaves[:7])
+	if err := VerifyConsistencyProof(older, newer, proof); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyConsistencyProof(newer, older, proof); err == nil {
+		t.Fatal("proof with the trees swapped was accepted")
+	}
+}
@@ -0,0 +1,179 @@
+package certificatetransparency
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// MigrateEntriesFile rewrites the entries file with the given name so that it
+// has the given header, which is typically from NewFileHeader; nil means
+// NewFileHeader(nil). This converts files without a header into the current
+// format, adds log metadata to a file that lacks it, or changes the codec.
+// If the codec is unchanged then the compressed entries are copied as they
+// are; otherwise each is decompressed and compressed again. If header is for
+// CodecZstd and has no dictionary then one is built, with NewZstdDictionary,
+// from the first entries of the file. The new file is written next to the old
+// one and renamed over it once it is complete, so an interrupted migration
+// leaves the original intact. The index file is removed since the offsets
+// change; it is rebuilt by UpdateIndex or OpenEntriesFile. It returns the
+// number of entries copied.
+//
+// If status is non-nil then periodic status updates, measured in bytes of the
+// original file, will be written to it and it will be closed on return.
+func MigrateEntriesFile(fileName string, header *FileHeader, status chan<- OperationStatus) (count uint64, err error) {
+	if status != nil {
+		defer close(status)
+	}
+	if header == nil {
+		header = NewFileHeader(nil)
+	}
+
+	in, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	src := EntriesFile{in}
+
+	oldHeader, err := src.Header()
+	if err != nil {
+		return 0, err
+	}
+	recompress := oldHeader.Codec != header.Codec || !bytes.Equal(oldHeader.Dictionary, header.Dictionary)
+	if header.Codec == CodecZstd && len(header.Dictionary) == 0 {
+		samples, err := src.sampleEntries(oldHeader, dictionarySamples)
+		if err != nil {
+			return 0, err
+		}
+		if len(samples) == 0 {
+			return 0, errors.New("certificatetransparency: no entries to build a dictionary from")
+		}
+		copied := *header
+		if copied.Dictionary, err = NewZstdDictionary(samples); err != nil {
+			return 0, err
+		}
+		header = &copied
+	}
+	records, err := src.newRecordReader(oldHeader, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	tmpName := fileName + ".tmp"
+	out, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if out != nil {
+			out.Close()
+			os.Remove(tmpName)
+		}
+	}()
+	dst := EntriesFile{out}
+	if err := dst.writeHeaderIfEmpty(header); err != nil {
+		return 0, err
+	}
+	appender, err := dst.NewAppender()
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		if status != nil && records.index%1000 == 0 {
+			status <- OperationStatus{uint64(oldHeader.size), uint64(records.offset), uint64(records.end)}
+		}
+
+		ent, err := records.next(false)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if ent.err != nil {
+			return 0, ent.err
+		}
+		if !recompress {
+			if err := appender.appendCompressed(ent.Raw); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		leafInput, extraData, err := ent.decompress()
+		if err != nil {
+			return 0, err
+		}
+		if err := appender.Append(&RawEntry{leafInput, extraData}); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := appender.Sync(); err != nil {
+		return 0, err
+	}
+	err = out.Close()
+	out = nil
+	if err != nil {
+		os.Remove(tmpName)
+		return 0, err
+	}
+
+	if err := os.Remove(IndexFileName(fileName)); err != nil && !os.IsNotExist(err) {
+		os.Remove(tmpName)
+		return 0, err
+	}
+	if err := os.Rename(tmpName, fileName); err != nil {
+		return 0, err
+	}
+	if err := syncDir(fileName); err != nil {
+		return 0, err
+	}
+	return records.index, nil
+}
+
+// syncDir waits for the directory containing fileName to reach stable
+// storage, so that a file renamed to fileName stays renamed after a crash.
+func syncDir(fileName string) error {
+	dir, err := os.Open(filepath.Dir(fileName))
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+	return dir.Close()
+}
+
+// dictionarySamples is the number of entries that MigrateEntriesFile uses to
+// build a zstd dictionary.
+const dictionarySamples = 10000
+
+// sampleEntries returns up to n entries from the start of f, which has header
+// h.
+func (f EntriesFile) sampleEntries(h *FileHeader, n int) ([]RawEntry, error) {
+	records, err := f.newRecordReader(h, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	var samples []RawEntry
+	for len(samples) < n {
+		ent, err := records.next(false)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		leafInput, extraData, err := ent.decompress()
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, RawEntry{leafInput, extraData})
+	}
+	return samples, nil
+}
@@ -0,0 +1,77 @@
+package certificatetransparency
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+// readTestEntries returns the tree hash of the entries file with the given
+// name and the decompressed contents of each of its entries.
+func readTestEntries(t *testing.T, fileName string) ([32]byte, []RawEntry) {
+	f, count, err := OpenEntriesFile(fileName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ents, err := f.ReadRange(0, count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw []RawEntry
+	for i := range ents {
+		leafInput, extraData, err := ents[i].decompress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw = append(raw, RawEntry{leafInput, extraData})
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	root, err := f.HashTree(nil, count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root, raw
+}
+
+func TestMigrateEntriesFileRoundTrip(t *testing.T) {
+	const count = 300
+	for _, codec := range []string{CodecFlate, CodecNone, CodecZstd} {
+		fileName := filepath.Join(t.TempDir(), "entries")
+		writeTestEntries(t, fileName, nil, count)
+		wantRoot, want := readTestEntries(t, fileName)
+		if len(want) != count {
+			t.Fatalf("read %d entries, want %d", len(want), count)
+		}
+
+		header := NewFileHeader(nil)
+		header.Codec = codec
+		for _, step := range []*FileHeader{header, NewFileHeader(nil)} {
+			migrated, err := MigrateEntriesFile(fileName, step, nil)
+			if err != nil {
+				t.Fatalf("%s to %s: %s", codec, step.Codec, err)
+			}
+			if migrated != count {
+				t.Errorf("%s to %s: migrated %d entries, want %d", codec, step.Codec, migrated, count)
+			}
+
+			root, got := readTestEntries(t, fileName)
+			if root != wantRoot {
+				t.Errorf("%s to %s: tree hash changed", codec, step.Codec)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("%s to %s: %d entries, want %d", codec, step.Codec, len(got), len(want))
+			}
+			for i := range want {
+				if !bytes.Equal(got[i].LeafInput, want[i].LeafInput) || !bytes.Equal(got[i].ExtraData, want[i].ExtraData) {
+					t.Fatalf("%s to %s: entry %d changed", codec, step.Codec, i)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package certificatetransparency
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how failed requests to a log are retried. Network
+// errors, truncated responses and 429 or 5xx status codes are retried; other
+// errors are returned immediately.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times that a request will be
+	// made, including the first.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry. It doubles with
+	// each subsequent retry.
+	InitialBackoff time.Duration
+	// MaxBackoff limits the delay between attempts. A Retry-After header
+	// from the log may ask for a longer delay than this, and is honoured.
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is a RetryPolicy suitable for long-running downloads.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    8,
+	InitialBackoff: time.Second,
+	MaxBackoff:     2 * time.Minute,
+}
+
+// backoff returns the delay, with jitter, before the given retry attempt,
+// counting from one.
+func (policy *RetryPolicy) backoff(retry int) time.Duration {
+	d := policy.InitialBackoff
+	for i := 1; i < retry && d < policy.MaxBackoff; i++ {
+		d *= 2
+	}
+	if policy.MaxBackoff > 0 && d > policy.MaxBackoff {
+		d = policy.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	// Pick a delay in [d/2, d) so that concurrent clients spread out.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// ServerError is returned when a log replies with a status code other than
+// 200.
+type ServerError struct {
+	URL        string
+	StatusCode int
+	// RetryAfter contains the delay requested by the log in a Retry-After
+	// header, or zero.
+	RetryAfter time.Duration
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("certificatetransparency: error from server: %s returned %d", e.URL, e.StatusCode)
+}
+
+func (e *ServerError) temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which may either
+// be a number of seconds or an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if len(value) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// retryableError wraps errors that getJSON may retry.
+type retryableError struct {
+	err error
+}
+
+func (e retryableError) Error() string {
+	return e.err.Error()
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// waitForRateLimit blocks until the log's request rate limit allows another
+// request to be made.
+func (log *Log) waitForRateLimit(ctx context.Context) error {
+	if log.RequestsPerSecond <= 0 {
+		return nil
+	}
+	interval := time.Duration(float64(time.Second) / log.RequestsPerSecond)
+
+	log.rateMu.Lock()
+	now := time.Now()
+	if log.nextRequest.Before(now) {
+		log.nextRequest = now
+	}
+	wait := log.nextRequest.Sub(now)
+	log.nextRequest = log.nextRequest.Add(interval)
+	log.rateMu.Unlock()
+
+	return sleep(ctx, wait)
+}
@@ -0,0 +1,117 @@
+package certificatetransparency
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := &RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	tests := []struct {
+		retry int
+		max   time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{50, time.Second},
+	}
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			if d := policy.backoff(test.retry); d < test.max/2 || d > test.max {
+				t.Fatalf("retry %d: backoff is %s, want between %s and %s", test.retry, d, test.max/2, test.max)
+			}
+		}
+	}
+
+	if d := new(RetryPolicy).backoff(1); d != 0 {
+		t.Errorf("zero policy: backoff is %s", d)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value    string
+		min, max time.Duration
+	}{
+		{"", 0, 0},
+		{"5", 5 * time.Second, 5 * time.Second},
+		{"0", 0, 0},
+		{"-1", 0, 0},
+		{"soon", 0, 0},
+		{time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 58 * time.Second, time.Minute},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, 0},
+	}
+	for _, test := range tests {
+		if d := parseRetryAfter(test.value); d < test.min || d > test.max {
+			t.Errorf("%q: got %s, want between %s and %s", test.value, d, test.min, test.max)
+		}
+	}
+}
+
+// retryTestServer returns a server that replies to the first failures
+// requests with status and then with an empty tree-head. The number of
+// requests is counted in requests.
+func retryTestServer(failures int32, status int, retryAfter string, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(requests, 1) <= failures {
+			if len(retryAfter) > 0 {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(status)
+			return
+		}
+		w.Write([]byte(`{"tree_size":0,"timestamp":0}`))
+	}))
+}
+
+func TestLogRetry(t *testing.T) {
+	policy := &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	tests := []struct {
+		name       string
+		failures   int32
+		status     int
+		retryAfter string
+		retry      *RetryPolicy
+		attempts   int32
+		ok         bool
+		minElapsed time.Duration
+	}{
+		{"Retry-After honoured", 1, http.StatusServiceUnavailable, "1", policy, 2, true, time.Second},
+		{"recovers", 2, http.StatusServiceUnavailable, "", policy, 3, true, 0},
+		{"MaxAttempts", 10, http.StatusServiceUnavailable, "", policy, 3, false, 0},
+		{"too many requests", 10, http.StatusTooManyRequests, "", policy, 3, false, 0},
+		{"not retryable", 10, http.StatusNotFound, "", policy, 1, false, 0},
+		{"no policy", 10, http.StatusServiceUnavailable, "", nil, 1, false, 0},
+	}
+	for _, test := range tests {
+		var requests int32
+		server := retryTestServer(test.failures, test.status, test.retryAfter, &requests)
+		log := &Log{Root: server.URL, Retry: test.retry}
+
+		start := time.Now()
+		err := log.getJSON(context.Background(), "/ct/v1/get-sth", 1<<16, new(SignedTreeHead))
+		elapsed := time.Since(start)
+		server.Close()
+
+		if attempts := atomic.LoadInt32(&requests); attempts != test.attempts {
+			t.Errorf("%s: %d attempts, want %d", test.name, attempts, test.attempts)
+		}
+		if test.ok {
+			if err != nil {
+				t.Errorf("%s: %s", test.name, err)
+			}
+		} else if serverErr, ok := err.(*ServerError); !ok || serverErr.StatusCode != test.status {
+			t.Errorf("%s: got %v, want a ServerError with status %d", test.name, err, test.status)
+		}
+		if elapsed < test.minElapsed {
+			t.Errorf("%s: took %s, want at least %s", test.name, elapsed, test.minElapsed)
+		}
+	}
+}
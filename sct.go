@@ -0,0 +1,301 @@
+package certificatetransparency
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// sctListOID is the OID of the X.509 extension that contains embedded SCTs.
+// See https://tools.ietf.org/html/rfc6962#section-3.3
+var sctListOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+const sctVersion1 = 0
+
+// SignedCertificateTimestamp contains a parsed SCT. See
+// https://tools.ietf.org/html/rfc6962#section-3.2
+type SignedCertificateTimestamp struct {
+	Version uint8
+	LogID   LogID
+	// Timestamp is the raw time value from the log.
+	Timestamp uint64
+	// Time is Timestamp converted to a time.Time
+	Time       time.Time
+	Extensions []byte
+	// Signature contains the DigitallySigned structure.
+	Signature []byte
+}
+
+// readUint16Prefixed splits a uint16 length-prefixed value from the front of
+// x.
+func readUint16Prefixed(x []byte) (value, rest []byte, ok bool) {
+	if len(x) < 2 {
+		return nil, nil, false
+	}
+	l := int(x[0])<<8 | int(x[1])
+	x = x[2:]
+	if len(x) < l {
+		return nil, nil, false
+	}
+	return x[:l], x[l:], true
+}
+
+// ParseSCT parses a single serialized SCT.
+func ParseSCT(data []byte) (*SignedCertificateTimestamp, error) {
+	x := data
+	if len(x) < 1+32+8 {
+		return nil, errors.New("certificatetransparency: truncated SCT")
+	}
+
+	sct := new(SignedCertificateTimestamp)
+	sct.Version = x[0]
+	if sct.Version != sctVersion1 {
+		return nil, errors.New("certificatetransparency: unknown SCT version")
+	}
+	x = x[1:]
+	copy(sct.LogID[:], x)
+	x = x[32:]
+	sct.Timestamp = binary.BigEndian.Uint64(x)
+	sct.Time = time.Unix(int64(sct.Timestamp/1000), int64(sct.Timestamp%1000)*int64(time.Millisecond))
+	x = x[8:]
+
+	var ok bool
+	if sct.Extensions, x, ok = readUint16Prefixed(x); !ok {
+		return nil, errors.New("certificatetransparency: truncated SCT")
+	}
+
+	// The signature is a DigitallySigned structure: a hash algorithm, a
+	// signature algorithm and a uint16 length-prefixed signature.
+	if len(x) < 2 {
+		return nil, errors.New("certificatetransparency: truncated SCT")
+	}
+	if _, rest, ok := readUint16Prefixed(x[2:]); !ok || len(rest) > 0 {
+		return nil, errors.New("certificatetransparency: malformed SCT signature")
+	}
+	sct.Signature = x
+
+	return sct, nil
+}
+
+// ParseSCTList parses a SignedCertificateTimestampList, as found in the TLS
+// extension, OCSP extension or (inside an OCTET STRING) X.509 extension.
+func ParseSCTList(data []byte) ([]*SignedCertificateTimestamp, error) {
+	list, rest, ok := readUint16Prefixed(data)
+	if !ok || len(rest) > 0 {
+		return nil, errors.New("certificatetransparency: malformed SCT list")
+	}
+
+	var scts []*SignedCertificateTimestamp
+	for len(list) > 0 {
+		var serialized []byte
+		if serialized, list, ok = readUint16Prefixed(list); !ok {
+			return nil, errors.New("certificatetransparency: malformed SCT list")
+		}
+		sct, err := ParseSCT(serialized)
+		if err != nil {
+			return nil, err
+		}
+		scts = append(scts, sct)
+	}
+
+	return scts, nil
+}
+
+// EmbeddedSCTs returns the SCTs embedded in cert, if any.
+func EmbeddedSCTs(cert *x509.Certificate) ([]*SignedCertificateTimestamp, error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(sctListOID) {
+			continue
+		}
+
+		var list []byte
+		rest, err := asn1.Unmarshal(ext.Value, &list)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) > 0 {
+			return nil, errors.New("certificatetransparency: trailing data after SCT list")
+		}
+		return ParseSCTList(list)
+	}
+
+	return nil, nil
+}
+
+// removeSCTExtension returns tbs, a DER encoded TBSCertificate, with the
+// embedded SCT extension removed. This recreates the TBSCertificate that the
+// log signed when it issued the SCT for the precertificate.
+func removeSCTExtension(tbs []byte) ([]byte, error) {
+	var tbsSeq asn1.RawValue
+	if rest, err := asn1.Unmarshal(tbs, &tbsSeq); err != nil {
+		return nil, err
+	} else if len(rest) > 0 {
+		return nil, errors.New("certificatetransparency: trailing data after TBSCertificate")
+	}
+
+	var fields []byte
+	for x := tbsSeq.Bytes; len(x) > 0; {
+		var field asn1.RawValue
+		var err error
+		if x, err = asn1.Unmarshal(x, &field); err != nil {
+			return nil, err
+		}
+
+		if field.Class != asn1.ClassContextSpecific || field.Tag != 3 {
+			fields = append(fields, field.FullBytes...)
+			continue
+		}
+
+		// extensions [3] EXPLICIT Extensions
+		var extsSeq asn1.RawValue
+		if _, err := asn1.Unmarshal(field.Bytes, &extsSeq); err != nil {
+			return nil, err
+		}
+		var exts []byte
+		for y := extsSeq.Bytes; len(y) > 0; {
+			var ext asn1.RawValue
+			if y, err = asn1.Unmarshal(y, &ext); err != nil {
+				return nil, err
+			}
+			var parsed pkix.Extension
+			if _, err := asn1.Unmarshal(ext.FullBytes, &parsed); err != nil {
+				return nil, err
+			}
+			if !parsed.Id.Equal(sctListOID) {
+				exts = append(exts, ext.FullBytes...)
+			}
+		}
+		if len(exts) == 0 {
+			continue
+		}
+
+		extsDER, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: exts})
+		if err != nil {
+			return nil, err
+		}
+		fieldDER, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 3, IsCompound: true, Bytes: extsDER})
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, fieldDER...)
+	}
+
+	return asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: fields})
+}
+
+// sctSignedData returns the data covered by an SCT's signature for an entry
+// of the given type. For an X509Entry, entryData is the certificate. For a
+// PreCertEntry, it is the issuer key hash followed by the TBSCertificate.
+func sctSignedData(sct *SignedCertificateTimestamp, entryType LogEntryType, entryData []byte) []byte {
+	// See https://tools.ietf.org/html/rfc6962#section-3.2
+	signed := make([]byte, 0, 1+1+8+2+len(entryData)+3+2+len(sct.Extensions))
+	signed = append(signed, sct.Version, certificateTimestamp)
+	signed = binary.BigEndian.AppendUint64(signed, sct.Timestamp)
+	signed = binary.BigEndian.AppendUint16(signed, uint16(entryType))
+	switch entryType {
+	case X509Entry:
+		signed = appendUint24(signed, len(entryData))
+		signed = append(signed, entryData...)
+	case PreCertEntry:
+		signed = append(signed, entryData[:sha256.Size]...)
+		tbs := entryData[sha256.Size:]
+		signed = appendUint24(signed, len(tbs))
+		signed = append(signed, tbs...)
+	}
+	signed = binary.BigEndian.AppendUint16(signed, uint16(len(sct.Extensions)))
+	signed = append(signed, sct.Extensions...)
+	return signed
+}
+
+func appendUint24(x []byte, n int) []byte {
+	return append(x, byte(n>>16), byte(n>>8), byte(n))
+}
+
+// VerifySCT checks that sct is a valid signature by log over cert, where the
+// SCT was delivered separately from the certificate (i.e. in a TLS or OCSP
+// extension).
+func (log *Log) VerifySCT(sct *SignedCertificateTimestamp, cert *x509.Certificate) error {
+	if sct.LogID != log.ID() {
+		return errors.New("certificatetransparency: SCT is from a different log")
+	}
+	return verifyDigitallySigned(log.Key, sctSignedData(sct, X509Entry, cert.Raw), sct.Signature)
+}
+
+// VerifyEmbeddedSCT checks that sct, which was embedded in cert, is a valid
+// signature by log over the precertificate for cert. The issuer is needed
+// because the signature covers the hash of the issuer's public key.
+func (log *Log) VerifyEmbeddedSCT(sct *SignedCertificateTimestamp, cert, issuer *x509.Certificate) error {
+	if sct.LogID != log.ID() {
+		return errors.New("certificatetransparency: SCT is from a different log")
+	}
+
+	tbs, err := removeSCTExtension(cert.RawTBSCertificate)
+	if err != nil {
+		return err
+	}
+	issuerKeyHash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+	entryData := append(issuerKeyHash[:], tbs...)
+
+	return verifyDigitallySigned(log.Key, sctSignedData(sct, PreCertEntry, entryData), sct.Signature)
+}
+
+// SCTStatus contains the result of checking an SCT against a LogList.
+type SCTStatus struct {
+	SCT *SignedCertificateTimestamp
+	// Log contains the log that issued the SCT, or nil if it isn't in the
+	// LogList.
+	Log *LogData
+	// Err is nil if the SCT is valid.
+	Err error
+}
+
+// CheckEmbeddedSCTs verifies each SCT embedded in cert, which was issued by
+// issuer, against the matching log in list.
+func (list *LogList) CheckEmbeddedSCTs(cert, issuer *x509.Certificate) ([]SCTStatus, error) {
+	scts, err := EmbeddedSCTs(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []SCTStatus
+	for _, sct := range scts {
+		status := SCTStatus{SCT: sct, Log: list.LogByID(sct.LogID)}
+		switch {
+		case status.Log == nil:
+			status.Err = errors.New("certificatetransparency: SCT from unknown log " + sct.LogID.String())
+		case status.Log.PublicLog == nil:
+			status.Err = status.Log.KeyErr
+		default:
+			status.Err = status.Log.PublicLog.VerifyEmbeddedSCT(sct, cert, issuer)
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// CheckEntrySCTs verifies the SCTs embedded in the certificate of an
+// X509Entry.
+func (list *LogList) CheckEntrySCTs(entry *Entry) ([]SCTStatus, error) {
+	if entry.Type != X509Entry {
+		return nil, errors.New("certificatetransparency: only X509Entry entries contain embedded SCTs")
+	}
+
+	cert, err := x509.ParseCertificate(entry.X509Cert)
+	if err != nil {
+		return nil, err
+	}
+	issuer, err := entry.Issuer()
+	if err != nil {
+		return nil, err
+	}
+	if issuer == nil {
+		return nil, errors.New("certificatetransparency: entry has no issuer certificate")
+	}
+
+	return list.CheckEmbeddedSCTs(cert, issuer)
+}
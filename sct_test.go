@@ -0,0 +1,251 @@
+package certificatetransparency
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority that issues certificates with embedded
+// SCTs from a single log.
+type testCA struct {
+	key    *ecdsa.PrivateKey
+	cert   *x509.Certificate
+	logKey *ecdsa.PrivateKey
+	log    *Log
+}
+
+func newTestCA(t *testing.T) *testCA {
+	ca := new(testCA)
+	var err error
+	if ca.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Unix(1500000000, 0),
+		NotAfter:              time.Unix(1600000000, 0),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &ca.key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	if ca.logKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	ca.log = &Log{Root: "https://log.example/", Key: &ca.logKey.PublicKey}
+	return ca
+}
+
+// signECDSA returns a DigitallySigned structure over signed by key.
+func signECDSA(t *testing.T, key *ecdsa.PrivateKey, signed []byte) []byte {
+	digest := sha256.Sum256(signed)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := []byte{hashSHA256, sigECDSA}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(sig)))
+	return append(out, sig...)
+}
+
+// issue creates a certificate from template, issued by parent with parentKey,
+// with an SCT from the CA's log embedded in it. It returns the certificate
+// and the TBSCertificate of the precertificate that the SCT covers.
+func (ca *testCA) issue(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	precert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sct := &SignedCertificateTimestamp{LogID: ca.log.ID(), Timestamp: 1550000000000}
+	issuerKeyHash := sha256.Sum256(parent.RawSubjectPublicKeyInfo)
+	sct.Signature = signECDSA(t, ca.logKey, sctSignedData(sct, PreCertEntry, append(issuerKeyHash[:], precert.RawTBSCertificate...)))
+
+	serialized := []byte{sct.Version}
+	serialized = append(serialized, sct.LogID[:]...)
+	serialized = binary.BigEndian.AppendUint64(serialized, sct.Timestamp)
+	serialized = append(serialized, 0, 0)
+	serialized = append(serialized, sct.Signature...)
+	list := binary.BigEndian.AppendUint16(nil, uint16(2+len(serialized)))
+	list = binary.BigEndian.AppendUint16(list, uint16(len(serialized)))
+	list = append(list, serialized...)
+	value, err := asn1.Marshal(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withSCT := *template
+	withSCT.ExtraExtensions = append(withSCT.ExtraExtensions, pkix.Extension{Id: sctListOID, Value: value})
+	if der, err = x509.CreateCertificate(rand.Reader, &withSCT, parent, &key.PublicKey, parentKey); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, precert.RawTBSCertificate
+}
+
+func TestRemoveSCTExtension(t *testing.T) {
+	ca := newTestCA(t)
+
+	// A certificate with other extensions keeps them.
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "leaf.example"},
+		DNSNames:     []string{"leaf.example"},
+		NotBefore:    time.Unix(1500000000, 0),
+		NotAfter:     time.Unix(1600000000, 0),
+	}
+	cert, precertTBS := ca.issue(t, leaf, ca.cert, ca.key)
+	tbs, err := removeSCTExtension(cert.RawTBSCertificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tbs, precertTBS) {
+		t.Error("TBSCertificate with other extensions was not restored")
+	}
+
+	// A self-signed certificate without a subject key ID has no other
+	// extensions, so the extensions field must be dropped entirely.
+	bare := &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "bare.example"},
+		NotBefore:    time.Unix(1500000000, 0),
+		NotAfter:     time.Unix(1600000000, 0),
+	}
+	cert, precertTBS = ca.issue(t, bare, bare, ca.key)
+	if len(cert.Extensions) != 1 {
+		t.Fatalf("certificate has %d extensions, want only the SCT list", len(cert.Extensions))
+	}
+	if tbs, err = removeSCTExtension(cert.RawTBSCertificate); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tbs, precertTBS) {
+		t.Error("TBSCertificate with only the SCT extension was not restored")
+	}
+}
+
+func TestVerifyEmbeddedSCT(t *testing.T) {
+	ca := newTestCA(t)
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "leaf.example"},
+		DNSNames:     []string{"leaf.example"},
+		NotBefore:    time.Unix(1500000000, 0),
+		NotAfter:     time.Unix(1600000000, 0),
+	}
+	cert, _ := ca.issue(t, leaf, ca.cert, ca.key)
+	scts, err := EmbeddedSCTs(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scts) != 1 {
+		t.Fatalf("found %d SCTs, want 1", len(scts))
+	}
+	sct := scts[0]
+	if err := ca.log.VerifyEmbeddedSCT(sct, cert, ca.cert); err != nil {
+		t.Fatal(err)
+	}
+
+	otherCA := newTestCA(t)
+	tampered := func(modify func(sct *SignedCertificateTimestamp)) *SignedCertificateTimestamp {
+		copied := *sct
+		copied.Signature = append([]byte(nil), sct.Signature...)
+		modify(&copied)
+		return &copied
+	}
+	tests := []struct {
+		name   string
+		sct    *SignedCertificateTimestamp
+		issuer *x509.Certificate
+		log    *Log
+	}{
+		{"timestamp", tampered(func(sct *SignedCertificateTimestamp) { sct.Timestamp++ }), ca.cert, ca.log},
+		{"extensions", tampered(func(sct *SignedCertificateTimestamp) { sct.Extensions = []byte{0} }), ca.cert, ca.log},
+		{"signature", tampered(func(sct *SignedCertificateTimestamp) { sct.Signature[len(sct.Signature)-1] ^= 1 }), ca.cert, ca.log},
+		{"issuer key hash", sct, otherCA.cert, ca.log},
+		{"log", sct, ca.cert, otherCA.log},
+	}
+	for _, test := range tests {
+		if err := test.log.VerifyEmbeddedSCT(test.sct, cert, test.issuer); err == nil {
+			t.Errorf("SCT with wrong %s was accepted", test.name)
+		}
+	}
+}
+
+func TestCheckEmbeddedSCTs(t *testing.T) {
+	ca := newTestCA(t)
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "leaf.example"},
+		NotBefore:    time.Unix(1500000000, 0),
+		NotAfter:     time.Unix(1600000000, 0),
+	}
+	cert, _ := ca.issue(t, leaf, ca.cert, ca.key)
+
+	spki, err := x509.MarshalPKIXPublicKey(ca.log.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := ca.log.ID()
+	data, err := json.Marshal(map[string]interface{}{
+		"operators": []interface{}{
+			map[string]interface{}{
+				"name": "Operator",
+				"logs": []interface{}{
+					map[string]interface{}{"log_id": id[:], "key": spki, "url": ca.log.Root},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := LoadLogList(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err := list.CheckEmbeddedSCTs(cert, ca.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[0].Log == nil || statuses[0].Err != nil {
+		t.Fatalf("CheckEmbeddedSCTs returned %+v", statuses)
+	}
+
+	statuses, err = list.CheckEmbeddedSCTs(cert, newTestCA(t).cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[0].Err == nil {
+		t.Fatal("SCT was accepted with the wrong issuer")
+	}
+}
@@ -0,0 +1,81 @@
+package certificatetransparency
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+)
+
+// verifyDigitallySigned checks that sig, a TLS DigitallySigned structure,
+// is a valid signature by key over signed. The signature algorithm is taken
+// from the DigitallySigned header and must match the type of key.
+//
+// See https://tools.ietf.org/html/rfc5246#section-4.7
+func verifyDigitallySigned(key crypto.PublicKey, signed, sig []byte) error {
+	if len(sig) < 4 {
+		return errors.New("certificatetransparency: signature truncated")
+	}
+	if sig[0] != hashSHA256 {
+		return errors.New("certificatetransparency: unknown hash function")
+	}
+	sigAlgorithm := sig[1]
+	sigLen := int(sig[2])<<8 | int(sig[3])
+	signatureBytes := sig[4:]
+	if len(signatureBytes) != sigLen {
+		return errors.New("certificatetransparency: signature length mismatch")
+	}
+
+	switch sigAlgorithm {
+	case sigECDSA:
+		if _, ok := key.(*ecdsa.PublicKey); !ok {
+			return errors.New("certificatetransparency: ECDSA signature but log key is not ECDSA")
+		}
+	case sigRSA:
+		if _, ok := key.(*rsa.PublicKey); !ok {
+			return errors.New("certificatetransparency: RSA signature but log key is not RSA")
+		}
+	default:
+		return errors.New("certificatetransparency: unknown signature algorithm")
+	}
+
+	return verifySignature(key, signed, signatureBytes)
+}
+
+// verifySignature checks that sig is a valid SHA-256 signature by key over
+// signed. ECDSA signatures are ASN.1 encoded and RSA signatures use PKCS#1
+// v1.5.
+func verifySignature(key crypto.PublicKey, signed, sig []byte) error {
+	h := sha256.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		var ecdsaSig struct {
+			R, S *big.Int
+		}
+		rest, err := asn1.Unmarshal(sig, &ecdsaSig)
+		if err != nil {
+			return errors.New("certificatetransparency: failed to parse signature: " + err.Error())
+		}
+		if len(rest) > 0 {
+			return errors.New("certificatetransparency: trailing garbage after signature")
+		}
+
+		if !ecdsa.Verify(key, digest, ecdsaSig.R, ecdsaSig.S) {
+			return errors.New("certificatetransparency: signature verification failed")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, sig); err != nil {
+			return errors.New("certificatetransparency: signature verification failed")
+		}
+	default:
+		return errors.New("certificatetransparency: unsupported key type")
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package certificatetransparency
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+)
+
+func TestVerifySignedTreeHeadRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := &Log{Root: "https://log.example/", Key: &key.PublicKey}
+
+	hash := sha256.Sum256([]byte("root"))
+	head := &SignedTreeHead{Size: 1234, Timestamp: 1500000000123, Hash: hash[:]}
+	signed := []byte{logVersion, treeHash}
+	signed = binary.BigEndian.AppendUint64(signed, head.Timestamp)
+	signed = binary.BigEndian.AppendUint64(signed, head.Size)
+	digest := sha256.Sum256(append(signed, head.Hash...))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	head.Signature = []byte{hashSHA256, sigRSA}
+	head.Signature = binary.BigEndian.AppendUint16(head.Signature, uint16(len(sig)))
+	head.Signature = append(head.Signature, sig...)
+
+	if err := log.verifySignedTreeHead(head); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(head *SignedTreeHead)
+	}{
+		{"hash algorithm", func(head *SignedTreeHead) { head.Signature[0] = 2 }},
+		{"ECDSA signature algorithm", func(head *SignedTreeHead) { head.Signature[1] = sigECDSA }},
+		{"unknown signature algorithm", func(head *SignedTreeHead) { head.Signature[1] = 2 }},
+		{"signature", func(head *SignedTreeHead) { head.Signature[len(head.Signature)-1] ^= 1 }},
+		{"signature length", func(head *SignedTreeHead) { head.Signature = head.Signature[:len(head.Signature)-1] }},
+		{"tree size", func(head *SignedTreeHead) { head.Size++ }},
+		{"timestamp", func(head *SignedTreeHead) { head.Timestamp++ }},
+	}
+	for _, test := range tests {
+		modified := *head
+		modified.Signature = append([]byte(nil), head.Signature...)
+		test.modify(&modified)
+		if err := log.verifySignedTreeHead(&modified); err == nil {
+			t.Errorf("%s: modified tree-head was accepted", test.name)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package certificatetransparency
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// An STHStore is an append-only record of the signed tree-heads that have
+// been seen from a log. It is kept in a file, one JSON object per line, next
+// to the log's entries file.
+type STHStore struct {
+	fileName string
+	// Latest contains the most recently added tree-head, or nil if the
+	// store is empty.
+	Latest *SignedTreeHead
+}
+
+// STHStoreFileName returns the name of the file that holds the tree-heads for
+// the entries file with the given name. For logs from a LogList the entries
+// file is named after LogData.SafeFileName.
+func STHStoreFileName(entriesFileName string) string {
+	return entriesFileName + ".sth"
+}
+
+// OpenSTHStore reads the tree-heads stored in fileName. The file need not
+// exist.
+func OpenSTHStore(fileName string) (*STHStore, error) {
+	store := &STHStore{fileName: fileName}
+
+	in, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		head := new(SignedTreeHead)
+		if err := json.Unmarshal(line, head); err != nil {
+			return nil, err
+		}
+		head.Time = time.Unix(int64(head.Timestamp/1000), int64(head.Timestamp%1000)*int64(time.Millisecond))
+		store.Latest = head
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// An STHConflictError is returned by STHStore.Add when a log has produced a
+// tree-head that cannot follow the previous one. Old and New are both signed
+// by the log and so, together, are evidence of misbehaviour.
+type STHConflictError struct {
+	Old, New *SignedTreeHead
+	Reason   string
+}
+
+func (e *STHConflictError) Error() string {
+	return fmt.Sprintf("certificatetransparency: tree-head of size %d at %d conflicts with previous tree-head of size %d at %d: %s", e.New.Size, e.New.Timestamp, e.Old.Size, e.Old.Timestamp, e.Reason)
+}
+
+// Add checks that head, which must already have been verified, is a valid
+// successor of the latest stored tree-head and appends it to the store. If
+// the tree has grown, a consistency proof is fetched from log and checked.
+// A tree-head that is identical to the latest one is not stored again. If
+// head conflicts with the latest tree-head then both are appended to the
+// file named by ConflictFileName, so that the evidence is kept, and an
+// *STHConflictError is returned.
+func (store *STHStore) Add(ctx context.Context, log *Log, head *SignedTreeHead) error {
+	if old := store.Latest; old != nil {
+		conflict := func(reason string) error {
+			conflictErr := &STHConflictError{old, head, reason}
+			if err := store.recordConflict(conflictErr); err != nil {
+				return err
+			}
+			return conflictErr
+		}
+
+		if head.Size < old.Size {
+			return conflict("tree has shrunk")
+		}
+		if head.Timestamp < old.Timestamp {
+			return conflict("timestamp has gone backwards")
+		}
+		if head.Size == old.Size && !bytes.Equal(head.Hash, old.Hash) {
+			return conflict("tree hash differs for the same tree size")
+		}
+		if head.Timestamp == old.Timestamp && head.Size == old.Size {
+			return nil
+		}
+
+		if head.Size > old.Size && old.Size > 0 {
+			proof, err := log.GetSTHConsistency(ctx, old.Size, head.Size)
+			if err != nil {
+				return err
+			}
+			if err := VerifyConsistencyProof(old, head, proof); err != nil {
+				return conflict(err.Error())
+			}
+		}
+	}
+
+	line, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+	if err := appendLine(store.fileName, line); err != nil {
+		return err
+	}
+
+	store.Latest = head
+	return nil
+}
+
+// ConflictFileName returns the name of the file to which Add records
+// conflicting tree-heads.
+func (store *STHStore) ConflictFileName() string {
+	return store.fileName + ".conflict"
+}
+
+// recordConflict appends the tree-heads in conflictErr, with their
+// signatures, to the store's conflict file as a single JSON object.
+func (store *STHStore) recordConflict(conflictErr *STHConflictError) error {
+	line, err := json.Marshal(struct {
+		Old    *SignedTreeHead `json:"old"`
+		New    *SignedTreeHead `json:"new"`
+		Reason string          `json:"reason"`
+	}{conflictErr.Old, conflictErr.New, conflictErr.Reason})
+	if err != nil {
+		return err
+	}
+	return appendLine(store.ConflictFileName(), line)
+}
+
+// appendLine appends line and a newline to the named file, creating it if
+// needed, and waits for it to reach stable storage.
+func appendLine(fileName string, line []byte) error {
+	out, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(append(line, '\n')); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
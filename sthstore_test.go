@@ -0,0 +1,131 @@
+package certificatetransparency
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// signTreeHead sets the signature on head using key.
+func signTreeHead(t *testing.T, key *ecdsa.PrivateKey, head *SignedTreeHead) {
+	signed := []byte{logVersion, treeHash}
+	signed = binary.BigEndian.AppendUint64(signed, head.Timestamp)
+	signed = binary.BigEndian.AppendUint64(signed, head.Size)
+	head.Signature = signECDSA(t, key, append(signed, head.Hash...))
+}
+
+func TestOpenSTHStoreTime(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "entries.sth")
+	line := `{"tree_size":1,"timestamp":1500000000123,"sha256_root_hash":"","tree_head_signature":""}` + "\n"
+	if err := ioutil.WriteFile(fileName, []byte(line), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenSTHStore(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Unix(1500000000, 123*int64(time.Millisecond))
+	if !store.Latest.Time.Equal(want) {
+		t.Errorf("Time is %s, want %s", store.Latest.Time, want)
+	}
+
+	// A tree-head fetched from a log has the same time once stored.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(nil)
+	sth := &SignedTreeHead{Size: 0, Timestamp: 1500000000456, Hash: hash[:]}
+	signTreeHead(t, key, sth)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(sth)
+	}))
+	defer server.Close()
+
+	log := &Log{Root: server.URL, Key: &key.PublicKey}
+	head, err := log.GetSignedTreeHead(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = time.Unix(1500000000, 456*int64(time.Millisecond))
+	if !head.Time.Equal(want) {
+		t.Errorf("fetched Time is %s, want %s", head.Time, want)
+	}
+
+	fileName = filepath.Join(t.TempDir(), "entries.sth")
+	store, err = OpenSTHStore(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add(context.Background(), log, head); err != nil {
+		t.Fatal(err)
+	}
+	if store, err = OpenSTHStore(fileName); err != nil {
+		t.Fatal(err)
+	}
+	if !store.Latest.Time.Equal(head.Time) {
+		t.Errorf("stored Time is %s, want %s", store.Latest.Time, head.Time)
+	}
+}
+
+func TestSTHStoreRecordsConflict(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := &Log{Root: "https://log.example/", Key: &key.PublicKey}
+	oldHash := sha256.Sum256([]byte("old"))
+	old := &SignedTreeHead{Size: 10, Timestamp: 1500000000000, Hash: oldHash[:]}
+	signTreeHead(t, key, old)
+	newHash := sha256.Sum256([]byte("new"))
+	head := &SignedTreeHead{Size: 10, Timestamp: 1500000001000, Hash: newHash[:]}
+	signTreeHead(t, key, head)
+
+	store, err := OpenSTHStore(filepath.Join(t.TempDir(), "entries.sth"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add(context.Background(), log, old); err != nil {
+		t.Fatal(err)
+	}
+	err = store.Add(context.Background(), log, head)
+	if _, ok := err.(*STHConflictError); !ok {
+		t.Fatalf("Add returned %v, want an *STHConflictError", err)
+	}
+
+	data, err := ioutil.ReadFile(store.ConflictFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recorded struct {
+		Old, New *SignedTreeHead
+	}
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		t.Fatal(err)
+	}
+	for _, head := range []*SignedTreeHead{recorded.Old, recorded.New} {
+		if head == nil {
+			t.Fatal("conflict file is missing a tree-head")
+		}
+		if err := log.verifySignedTreeHead(head); err != nil {
+			t.Errorf("recorded tree-head of %d: %s", head.Timestamp, err)
+		}
+	}
+	if recorded.Old.Timestamp != old.Timestamp || recorded.New.Timestamp != head.Timestamp {
+		t.Errorf("recorded tree-heads at %d and %d, want %d and %d", recorded.Old.Timestamp, recorded.New.Timestamp, old.Timestamp, head.Timestamp)
+	}
+	if store.Latest != old {
+		t.Error("conflicting tree-head replaced the latest one")
+	}
+}
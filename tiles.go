@@ -0,0 +1,591 @@
+package certificatetransparency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements the client side of the static CT API, in which a log
+// publishes a signed checkpoint and its Merkle tree and entries as tiles. See
+// https://c2sp.org/static-ct-api and https://c2sp.org/tlog-tiles
+
+const (
+	// tileHeight is the number of tree levels covered by a tile.
+	tileHeight = 8
+	// tileWidth is the number of hashes, or entries, in a full tile.
+	tileWidth = 1 << tileHeight
+
+	maxCheckpointSize = 1 << 16
+	maxDataTileSize   = 64 << 20
+	maxIssuerSize     = 1 << 20
+)
+
+// rfc6962NoteSignature is the signature type of checkpoint signatures made
+// with a log's RFC 6962 key. See https://c2sp.org/static-ct-api#checkpoints
+const rfc6962NoteSignature = 0x05
+
+// origin returns the name of the log in its checkpoint.
+func (log *Log) origin() string {
+	if len(log.Origin) > 0 {
+		return log.Origin
+	}
+	origin := strings.TrimPrefix(log.Root, "https://")
+	origin = strings.TrimPrefix(origin, "http://")
+	return strings.TrimSuffix(origin, "/")
+}
+
+// getTile fetches path, relative to log.TileRoot, retrying according to
+// log.Retry.
+func (log *Log) getTile(ctx context.Context, path string, maxLen int64) ([]byte, error) {
+	var data []byte
+	err := log.retry(ctx, func() error {
+		var err error
+		data, err = log.getOnce(ctx, strings.TrimSuffix(log.TileRoot, "/")+"/"+path, maxLen)
+		return err
+	})
+	return data, err
+}
+
+// getCheckpoint fetches the log's checkpoint and verifies the signature from
+// the log's key. The checkpoint is returned as a SignedTreeHead that can be
+// checked and stored like one from the JSON API. Later calls to
+// GetSTHConsistency and DownloadRange read tiles for this tree.
+func (log *Log) getCheckpoint(ctx context.Context) (*SignedTreeHead, error) {
+	note, err := log.getTile(ctx, "checkpoint", maxCheckpointSize)
+	if err != nil {
+		return nil, err
+	}
+	head, err := log.parseCheckpoint(note)
+	if err != nil {
+		return nil, err
+	}
+
+	log.tilesMu.Lock()
+	if log.tiles == nil || log.tiles.head.Size != head.Size || !bytes.Equal(log.tiles.head.Hash, head.Hash) {
+		log.tiles = &tileReader{log: log, head: head}
+	}
+	log.tilesMu.Unlock()
+
+	return head, nil
+}
+
+// parseCheckpoint parses a checkpoint, which is a signed note, and verifies
+// the log's signature on it.
+func (log *Log) parseCheckpoint(note []byte) (*SignedTreeHead, error) {
+	text := string(note)
+	i := strings.Index(text, "\n\n")
+	if i < 0 {
+		return nil, errors.New("certificatetransparency: malformed checkpoint")
+	}
+	body, sigs := strings.Split(text[:i], "\n"), text[i+2:]
+	if len(body) < 3 {
+		return nil, errors.New("certificatetransparency: malformed checkpoint")
+	}
+
+	origin := log.origin()
+	if body[0] != origin {
+		return nil, fmt.Errorf("certificatetransparency: checkpoint is for %q, not %q", body[0], origin)
+	}
+	head := new(SignedTreeHead)
+	var err error
+	if head.Size, err = strconv.ParseUint(body[1], 10, 64); err != nil {
+		return nil, errors.New("certificatetransparency: malformed tree size in checkpoint")
+	}
+	if head.Hash, err = base64.StdEncoding.DecodeString(body[2]); err != nil || len(head.Hash) != sha256.Size {
+		return nil, errors.New("certificatetransparency: malformed root hash in checkpoint")
+	}
+
+	logID := log.ID()
+	keyHash := sha256.New()
+	keyHash.Write([]byte(origin))
+	keyHash.Write([]byte{'\n', rfc6962NoteSignature})
+	keyHash.Write(logID[:])
+	keyID := keyHash.Sum(nil)[:4]
+
+	if !strings.HasSuffix(sigs, "\n") {
+		return nil, errors.New("certificatetransparency: malformed checkpoint signatures")
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(sigs, "\n"), "\n") {
+		// Each line is "— <name> <base64 signature>".
+		fields := strings.Split(line, " ")
+		if len(fields) != 3 || fields[0] != "—" {
+			return nil, errors.New("certificatetransparency: malformed checkpoint signature line")
+		}
+		if fields[1] != origin {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(fields[2])
+		if err != nil || len(sig) < 4+8 || !bytes.Equal(sig[:4], keyID) {
+			continue
+		}
+
+		head.Timestamp = binary.BigEndian.Uint64(sig[4:])
+		head.Time = time.Unix(int64(head.Timestamp/1000), int64(head.Timestamp%1000)*int64(time.Millisecond))
+		head.Signature = sig[12:]
+		if err := log.verifySignedTreeHead(head); err != nil {
+			return nil, err
+		}
+		return head, nil
+	}
+
+	return nil, errors.New("certificatetransparency: checkpoint is not signed by the log's key")
+}
+
+// currentTiles returns the tileReader for the last checkpoint fetched.
+func (log *Log) currentTiles() (*tileReader, error) {
+	log.tilesMu.Lock()
+	defer log.tilesMu.Unlock()
+	if log.tiles == nil {
+		return nil, errors.New("certificatetransparency: no checkpoint has been fetched from the tiled log")
+	}
+	return log.tiles, nil
+}
+
+// tilePath returns the path of a tile, relative to the monitoring prefix.
+// level is either a number or "data" and width is the number of entries in
+// the tile.
+func tilePath(level string, n, width uint64) string {
+	// The index is split into groups of three digits, all but the last of
+	// which are prefixed with "x".
+	path := fmt.Sprintf("%03d", n%1000)
+	for n >= 1000 {
+		n /= 1000
+		path = fmt.Sprintf("x%03d/", n%1000) + path
+	}
+	path = "tile/" + level + "/" + path
+	if width < tileWidth {
+		path += fmt.Sprintf(".p/%d", width)
+	}
+	return path
+}
+
+type tileKey struct {
+	level, n uint64
+}
+
+// tileReader reads the Merkle tree of a tiled log, for the tree described by
+// a single checkpoint, and checks the hash tiles that it reads against the
+// checkpoint's root hash.
+type tileReader struct {
+	log  *Log
+	head *SignedTreeHead
+
+	mu sync.Mutex
+	// verified contains the verified tiles above level zero, which are
+	// needed to verify each tile below them.
+	verified map[tileKey][]byte
+	// issuers maps the SHA-256 fingerprint of an issuer to its certificate.
+	issuers map[[sha256.Size]byte][]byte
+
+	edgeMu sync.Mutex
+	// edgeChecked is true once the partial tiles on the right edge of the
+	// tree have been checked against the root hash.
+	edgeChecked bool
+}
+
+// width returns the number of hashes in the nth tile at the given level.
+func (r *tileReader) width(level, n uint64) uint64 {
+	stored := r.head.Size >> (level * tileHeight)
+	if start := n * tileWidth; start < stored {
+		if stored-start < tileWidth {
+			return stored - start
+		}
+		return tileWidth
+	}
+	return 0
+}
+
+// fetchHashTile fetches the nth hash tile at the given level without
+// verifying it.
+func (r *tileReader) fetchHashTile(ctx context.Context, level, n uint64) ([]byte, error) {
+	width := r.width(level, n)
+	if width == 0 {
+		return nil, errors.New("certificatetransparency: tile is beyond the end of the tree")
+	}
+	tile, err := r.log.getTile(ctx, tilePath(strconv.FormatUint(level, 10), n, width), int64(width)*sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(tile)) != width*sha256.Size {
+		return nil, errors.New("certificatetransparency: hash tile has wrong length")
+	}
+	return tile, nil
+}
+
+// tileHashReader returns hashes from the tiles at one tile level.
+type tileHashReader func(ctx context.Context, level, n uint64) ([]byte, error)
+
+// nodeHash returns the hash of the complete subtree at the given tree level
+// and index, reading it from the tiles below it.
+func nodeHash(ctx context.Context, read tileHashReader, level, index uint64) ([]byte, error) {
+	tileLevel, height := level/tileHeight, level%tileHeight
+	first := index << height
+	tile, err := read(ctx, tileLevel, first/tileWidth)
+	if err != nil {
+		return nil, err
+	}
+	start := (first % tileWidth) * sha256.Size
+	end := start + (1<<height)*sha256.Size
+	if end > uint64(len(tile)) {
+		return nil, errors.New("certificatetransparency: node is missing from tile")
+	}
+	return hashTileRange(tile[start:end]), nil
+}
+
+// hashTileRange returns the root of the complete subtree whose nodes are the
+// concatenated hashes in hashes.
+func hashTileRange(hashes []byte) []byte {
+	var nodes [][]byte
+	for i := 0; i < len(hashes); i += sha256.Size {
+		nodes = append(nodes, hashes[i:i+sha256.Size])
+	}
+	for len(nodes) > 1 {
+		for i := 0; i < len(nodes); i += 2 {
+			nodes[i/2] = hashChildren(nodes[i], nodes[i+1])
+		}
+		nodes = nodes[:len(nodes)/2]
+	}
+	return nodes[0]
+}
+
+// subtreeHash returns the Merkle tree hash of the leaves from start till one
+// less than end. start must be a multiple of a power of two that is at least
+// end-start, as is the case for all subtrees in the RFC 6962 algorithms.
+func subtreeHash(ctx context.Context, read tileHashReader, start, end uint64) ([]byte, error) {
+	n := end - start
+	if n&(n-1) == 0 {
+		level := uint64(0)
+		for uint64(1)<<level < n {
+			level++
+		}
+		return nodeHash(ctx, read, level, start>>level)
+	}
+
+	k := largestPowerOfTwoBelow(n)
+	left, err := subtreeHash(ctx, read, start, start+k)
+	if err != nil {
+		return nil, err
+	}
+	right, err := subtreeHash(ctx, read, start+k, end)
+	if err != nil {
+		return nil, err
+	}
+	return hashChildren(left, right), nil
+}
+
+// largestPowerOfTwoBelow returns the largest power of two less than n, which
+// must be at least two.
+func largestPowerOfTwoBelow(n uint64) uint64 {
+	k := uint64(1)
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// checkRightEdge verifies the partial tiles at each level by checking that
+// they, together with the tiles above them, hash to the root hash in the
+// checkpoint. The verified partial tiles are recorded.
+func (r *tileReader) checkRightEdge(ctx context.Context) error {
+	r.edgeMu.Lock()
+	defer r.edgeMu.Unlock()
+	if r.edgeChecked || r.head.Size == 0 {
+		return nil
+	}
+
+	fetched := make(map[tileKey][]byte)
+	read := func(ctx context.Context, level, n uint64) ([]byte, error) {
+		key := tileKey{level, n}
+		if tile, ok := fetched[key]; ok {
+			return tile, nil
+		}
+		tile, err := r.fetchHashTile(ctx, level, n)
+		if err != nil {
+			return nil, err
+		}
+		fetched[key] = tile
+		return tile, nil
+	}
+
+	root, err := subtreeHash(ctx, read, 0, r.head.Size)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(root, r.head.Hash) {
+		return errors.New("certificatetransparency: tiles do not match the checkpoint's root hash")
+	}
+
+	r.mu.Lock()
+	if r.verified == nil {
+		r.verified = make(map[tileKey][]byte)
+	}
+	for key, tile := range fetched {
+		r.verified[key] = tile
+	}
+	r.mu.Unlock()
+	r.edgeChecked = true
+	return nil
+}
+
+// verifiedHashTile returns the nth hash tile at the given level, having
+// checked it against the checkpoint's root hash. Tiles above level zero are
+// kept for checking later tiles.
+func (r *tileReader) verifiedHashTile(ctx context.Context, level, n uint64) ([]byte, error) {
+	key := tileKey{level, n}
+	r.mu.Lock()
+	tile, ok := r.verified[key]
+	r.mu.Unlock()
+	if ok {
+		return tile, nil
+	}
+
+	if r.width(level, n) < tileWidth {
+		// Partial tiles are on the right edge of the tree and are
+		// checked against the root hash directly.
+		if err := r.checkRightEdge(ctx); err != nil {
+			return nil, err
+		}
+		r.mu.Lock()
+		tile, ok = r.verified[key]
+		r.mu.Unlock()
+		if !ok {
+			return nil, errors.New("certificatetransparency: partial tile was not verified")
+		}
+		return tile, nil
+	}
+
+	// The hash of a full tile is stored in the tile above it.
+	tile, err := r.fetchHashTile(ctx, level, n)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := r.verifiedHashTile(ctx, level+1, n/tileWidth)
+	if err != nil {
+		return nil, err
+	}
+	i := (n % tileWidth) * sha256.Size
+	if !bytes.Equal(hashTileRange(tile), parent[i:i+sha256.Size]) {
+		return nil, fmt.Errorf("certificatetransparency: hash tile %d at level %d does not match the tree", n, level)
+	}
+
+	if level > 0 {
+		r.mu.Lock()
+		if r.verified == nil {
+			r.verified = make(map[tileKey][]byte)
+		}
+		r.verified[key] = tile
+		r.mu.Unlock()
+	}
+	return tile, nil
+}
+
+// consistencyProof computes a consistency proof between the tree of size
+// first and the checkpoint's tree from the hash tiles. See
+// https://tools.ietf.org/html/rfc6962#section-2.1.2
+func (r *tileReader) consistencyProof(ctx context.Context, first uint64) ([][]byte, error) {
+	if first == 0 || first > r.head.Size {
+		return nil, errors.New("certificatetransparency: invalid tree size for consistency proof")
+	}
+	read := func(ctx context.Context, level, n uint64) ([]byte, error) {
+		return r.fetchHashTile(ctx, level, n)
+	}
+
+	var subproof func(m, start, end uint64, complete bool) ([][]byte, error)
+	subproof = func(m, start, end uint64, complete bool) ([][]byte, error) {
+		n := end - start
+		if m == n {
+			if complete {
+				return nil, nil
+			}
+			hash, err := subtreeHash(ctx, read, start, end)
+			if err != nil {
+				return nil, err
+			}
+			return [][]byte{hash}, nil
+		}
+
+		k := largestPowerOfTwoBelow(n)
+		if m <= k {
+			proof, err := subproof(m, start, start+k, complete)
+			if err != nil {
+				return nil, err
+			}
+			hash, err := subtreeHash(ctx, read, start+k, end)
+			if err != nil {
+				return nil, err
+			}
+			return append(proof, hash), nil
+		}
+		proof, err := subproof(m-k, start+k, end, false)
+		if err != nil {
+			return nil, err
+		}
+		hash, err := subtreeHash(ctx, read, start, start+k)
+		if err != nil {
+			return nil, err
+		}
+		return append(proof, hash), nil
+	}
+
+	return subproof(first, 0, r.head.Size, true)
+}
+
+// getTileEntryRange fetches the entries from start till one less than end
+// from the data tiles and checks their leaf hashes against the hash tiles.
+func (log *Log) getTileEntryRange(ctx context.Context, start, end uint64) ([]RawEntry, error) {
+	r, err := log.currentTiles()
+	if err != nil {
+		return nil, err
+	}
+	if end > r.head.Size {
+		return nil, errors.New("certificatetransparency: requested entries beyond the checkpoint")
+	}
+
+	var ents []RawEntry
+	for next := start; next < end; {
+		n := next / tileWidth
+		tile, err := r.dataTile(ctx, n)
+		if err != nil {
+			return ents, err
+		}
+		hi := uint64(len(tile))
+		if end-n*tileWidth < hi {
+			hi = end - n*tileWidth
+		}
+		batch := tile[next-n*tileWidth : hi]
+		valid, err := log.validateEntries(batch, next, end)
+		ents = append(ents, valid...)
+		if err != nil {
+			return ents, err
+		}
+		next += uint64(len(batch))
+	}
+	return ents, nil
+}
+
+// dataTile fetches the nth data tile and returns its entries, rebuilt into
+// the form returned by get-entries. The leaf hashes are checked against the
+// corresponding hash tile.
+func (r *tileReader) dataTile(ctx context.Context, n uint64) ([]RawEntry, error) {
+	width := r.width(0, n)
+	data, err := r.log.getTile(ctx, tilePath("data", n, width), maxDataTileSize)
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := r.verifiedHashTile(ctx, 0, n)
+	if err != nil {
+		return nil, err
+	}
+
+	var ents []RawEntry
+	for i := uint64(0); i < width; i++ {
+		var ent RawEntry
+		if ent, data, err = r.parseTileLeaf(ctx, data); err != nil {
+			return nil, &InvalidEntryError{r.log.TileRoot, n*tileWidth + i, err}
+		}
+		leafHash := LeafHash(ent.LeafInput)
+		if !bytes.Equal(leafHash[:], hashes[i*sha256.Size:(i+1)*sha256.Size]) {
+			return nil, &InvalidEntryError{r.log.TileRoot, n*tileWidth + i, errors.New("certificatetransparency: entry does not match the leaf hash in the tree")}
+		}
+		ents = append(ents, ent)
+	}
+	if len(data) > 0 {
+		return nil, errors.New("certificatetransparency: trailing data in data tile")
+	}
+
+	return ents, nil
+}
+
+// parseTileLeaf parses a TileLeaf from the front of data and rebuilds it into
+// a RawEntry. See https://c2sp.org/static-ct-api#log-entries
+func (r *tileReader) parseTileLeaf(ctx context.Context, data []byte) (ent RawEntry, rest []byte, err error) {
+	p := &tlsParser{x: data}
+	entryStart := len(p.x)
+	p.bytes(8) // timestamp
+	entryType := LogEntryType(p.uint16())
+	switch entryType {
+	case X509Entry:
+		p.vector(3, 1, 1<<24-1)
+	case PreCertEntry:
+		p.bytes(sha256.Size)
+		p.vector(3, 1, 1<<24-1)
+	default:
+		return ent, nil, errors.New("certificatetransparency: unknown entry type in data tile")
+	}
+	p.vector(2, 0, 1<<16-1) // extensions
+	if p.err != nil {
+		return ent, nil, p.err
+	}
+	timestampedEntry := data[:entryStart-len(p.x)]
+
+	var preCert []byte
+	if entryType == PreCertEntry {
+		preCert = p.vector(3, 1, 1<<24-1)
+	}
+	fingerprints := p.vector(2, 0, 1<<16-1)
+	if p.err != nil {
+		return ent, nil, p.err
+	}
+	if len(fingerprints)%sha256.Size != 0 {
+		return ent, nil, errors.New("certificatetransparency: malformed issuer fingerprints in data tile")
+	}
+
+	var chain []byte
+	for len(fingerprints) > 0 {
+		var fingerprint [sha256.Size]byte
+		copy(fingerprint[:], fingerprints)
+		fingerprints = fingerprints[sha256.Size:]
+		issuer, err := r.issuer(ctx, fingerprint)
+		if err != nil {
+			return ent, nil, err
+		}
+		chain = appendUint24(chain, len(issuer))
+		chain = append(chain, issuer...)
+	}
+
+	ent.LeafInput = append([]byte{logVersion, 0}, timestampedEntry...)
+	if entryType == PreCertEntry {
+		ent.ExtraData = appendUint24(ent.ExtraData, len(preCert))
+		ent.ExtraData = append(ent.ExtraData, preCert...)
+	}
+	ent.ExtraData = appendUint24(ent.ExtraData, len(chain))
+	ent.ExtraData = append(ent.ExtraData, chain...)
+
+	return ent, p.x, nil
+}
+
+// issuer fetches the issuer certificate with the given SHA-256 fingerprint.
+func (r *tileReader) issuer(ctx context.Context, fingerprint [sha256.Size]byte) ([]byte, error) {
+	r.mu.Lock()
+	cert, ok := r.issuers[fingerprint]
+	r.mu.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	cert, err := r.log.getTile(ctx, "issuer/"+hex.EncodeToString(fingerprint[:]), maxIssuerSize)
+	if err != nil {
+		return nil, err
+	}
+	if sha256.Sum256(cert) != fingerprint {
+		return nil, errors.New("certificatetransparency: issuer certificate does not match its fingerprint")
+	}
+
+	r.mu.Lock()
+	if r.issuers == nil {
+		r.issuers = make(map[[sha256.Size]byte][]byte)
+	}
+	r.issuers[fingerprint] = cert
+	r.mu.Unlock()
+	return cert, nil
+}
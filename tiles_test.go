@@ -0,0 +1,169 @@
+package certificatetransparency
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// hashTileServer serves the hash tiles, including the partial ones, of the
+// trees of every size up to the number of leaves.
+func hashTileServer(leaves [][]byte) *httptest.Server {
+	var nodes [][][]byte
+	for level := uint64(0); uint64(len(leaves))>>(level*tileHeight) > 0; level++ {
+		height := level * tileHeight
+		var hashes [][]byte
+		for i := uint64(0); (i+1)<<height <= uint64(len(leaves)); i++ {
+			hashes = append(hashes, referenceHash(leaves[i<<height:(i+1)<<height]))
+		}
+		nodes = append(nodes, hashes)
+	}
+
+	tiles := make(map[string][]byte)
+	for level, hashes := range nodes {
+		for end := 1; end <= len(hashes); end++ {
+			n := (end - 1) / tileWidth
+			var tile []byte
+			for _, h := range hashes[n*tileWidth : end] {
+				tile = append(tile, h...)
+			}
+			tiles["/"+tilePath(strconv.Itoa(level), uint64(n), uint64(end-n*tileWidth))] = tile
+		}
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tile, ok := tiles[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(tile)
+	}))
+}
+
+func TestTileConsistencyProof(t *testing.T) {
+	var leaves [][]byte
+	for i := 0; i < 600; i++ {
+		leaves = append(leaves, []byte(fmt.Sprintf("leaf %d", i)))
+	}
+	srv := hashTileServer(leaves)
+	defer srv.Close()
+
+	for _, size := range []int{1, 8, 256, 300, 512, 600} {
+		head := &SignedTreeHead{Size: uint64(size), Hash: referenceHash(leaves[:size])}
+		r := &tileReader{log: &Log{TileRoot: srv.URL}, head: head}
+		for _, first := range []int{1, 2, 3, 7, 8, 255, 256, 257, 299, 300, 511, 512, 599, 600} {
+			if first > size {
+				continue
+			}
+			proof, err := r.consistencyProof(context.Background(), uint64(first))
+			if err != nil {
+				t.Errorf("trees of sizes %d and %d: %s", first, size, err)
+				continue
+			}
+			want := referenceProof(first, leaves[:size])
+			if len(proof) != len(want) {
+				t.Errorf("trees of sizes %d and %d: proof has %d hashes, want %d", first, size, len(proof), len(want))
+				continue
+			}
+			for i := range want {
+				if string(proof[i]) != string(want[i]) {
+					t.Errorf("trees of sizes %d and %d: hash %d of proof differs", first, size, i)
+				}
+			}
+			if err := verifyConsistency(uint64(first), uint64(size), referenceHash(leaves[:first]), head.Hash, proof); err != nil {
+				t.Errorf("trees of sizes %d and %d: %s", first, size, err)
+			}
+		}
+
+		for _, first := range []uint64{0, uint64(size) + 1} {
+			if _, err := r.consistencyProof(context.Background(), first); err == nil {
+				t.Errorf("proof from size %d to %d was computed", first, size)
+			}
+		}
+	}
+}
+
+// signCheckpoint returns a checkpoint for the given tree, signed by key as
+// the log with the given origin and ID.
+func signCheckpoint(t *testing.T, key *ecdsa.PrivateKey, origin string, logID LogID, size, timestamp uint64, hash []byte) string {
+	signed := []byte{logVersion, treeHash}
+	signed = binary.BigEndian.AppendUint64(signed, timestamp)
+	signed = binary.BigEndian.AppendUint64(signed, size)
+	signed = append(signed, hash...)
+	digest := sha256.Sum256(signed)
+	der, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyHash := sha256.New()
+	keyHash.Write([]byte(origin))
+	keyHash.Write([]byte{'\n', rfc6962NoteSignature})
+	keyHash.Write(logID[:])
+	sig := keyHash.Sum(nil)[:4]
+	sig = binary.BigEndian.AppendUint64(sig, timestamp)
+	sig = append(sig, hashSHA256, sigECDSA)
+	sig = binary.BigEndian.AppendUint16(sig, uint16(len(der)))
+	sig = append(sig, der...)
+
+	return fmt.Sprintf("%s\n%d\n%s\n\n— %s %s\n", origin, size, base64.StdEncoding.EncodeToString(hash), origin, base64.StdEncoding.EncodeToString(sig))
+}
+
+func TestParseCheckpoint(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := &Log{Root: "https://log.example/2025h1/", Key: &key.PublicKey}
+	const origin = "log.example/2025h1"
+	hash := mustDecodeHex(referenceRoots[7])
+	valid := signCheckpoint(t, key, origin, log.ID(), 8, 1500000000123, hash)
+
+	head, err := log.parseCheckpoint([]byte(valid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Size != 8 || string(head.Hash) != string(hash) || head.Timestamp != 1500000000123 {
+		t.Errorf("parsed checkpoint is size %d, hash %x, timestamp %d", head.Size, head.Hash, head.Timestamp)
+	}
+
+	body, sigs := valid[:strings.Index(valid, "\n\n")], valid[strings.Index(valid, "\n\n")+2:]
+	otherLine := strings.SplitN(signCheckpoint(t, otherKey, origin, log.ID(), 8, 1500000000123, hash), "\n\n", 2)[1]
+	tests := []struct {
+		name, note string
+	}{
+		{"empty", ""},
+		{"no signatures", body + "\n"},
+		{"short body", origin + "\n8\n\n" + sigs},
+		{"wrong origin", strings.Replace(valid, origin+"\n", "other.example\n", 1)},
+		{"bad size", strings.Replace(body, "\n8\n", "\n-8\n", 1) + "\n\n" + sigs},
+		{"size changed", strings.Replace(body, "\n8\n", "\n9\n", 1) + "\n\n" + sigs},
+		{"bad hash", origin + "\n8\n!!!!\n\n" + sigs},
+		{"short hash", origin + "\n8\n" + base64.StdEncoding.EncodeToString(hash[:31]) + "\n\n" + sigs},
+		{"hash changed", origin + "\n8\n" + base64.StdEncoding.EncodeToString(flipped(hash)) + "\n\n" + sigs},
+		{"unterminated signature", strings.TrimSuffix(valid, "\n")},
+		{"malformed signature line", body + "\n\n" + strings.Replace(sigs, "— ", "-- ", 1)},
+		{"signature by another key", body + "\n\n" + otherLine},
+		{"signature for another origin", body + "\n\n" + strings.Replace(sigs, origin, "other.example", 1)},
+	}
+	for _, test := range tests {
+		if _, err := log.parseCheckpoint([]byte(test.note)); err == nil {
+			t.Errorf("%s: malformed checkpoint was accepted", test.name)
+		}
+	}
+}
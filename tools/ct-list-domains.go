@@ -5,7 +5,6 @@
 package main
 
 import (
-	"crypto/x509"
 	//"encoding/pem"
 	"fmt"
 	"os"
@@ -33,12 +32,13 @@ func main() {
 
 	//outputLock := new(sync.Mutex)
 
-	entriesFile.Map(func(ent *certificatetransparency.EntryAndPosition, err error) {
+	err = entriesFile.Map(func(ent *certificatetransparency.EntryAndPosition, err error) {
 		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
 			return
 		}
 
-		cert, err := x509.ParseCertificate(ent.Entry.X509Cert)
+		cert, err := ent.Entry.Certificate()
 		if err != nil {
 			return
 		}
@@ -62,4 +62,8 @@ func main() {
 			outputLock.Unlock()
 		}*/
 	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read entries file: %s\n", err)
+		os.Exit(1)
+	}
 }
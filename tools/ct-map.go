@@ -33,8 +33,9 @@ func main() {
 
 	outputLock := new(sync.Mutex)
 
-	entriesFile.Map(func(ent *certificatetransparency.EntryAndPosition, err error) {
+	err = entriesFile.Map(func(ent *certificatetransparency.EntryAndPosition, err error) {
 		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
 			return
 		}
 
@@ -59,4 +60,8 @@ func main() {
 			outputLock.Unlock()
 		}
 	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read entries file: %s\n", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,113 @@
+// This utility program converts a log entries file into the current format,
+// with a header and per-record checksums. If a log URL is given then the log's
+// URL and ID, from the log list, are recorded in the header. The log list's
+// signature is checked against the key given with -log-list-key. The -codec flag
+// recompresses the entries with the named codec: flate, zstd or none. For
+// zstd, a dictionary is built from the first entries of the file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/agl/certificatetransparency"
+)
+
+// loadLogList fetches the log list and checks its signature against the key in
+// keyFileName. If keyFileName is empty then the signature is only skipped if
+// insecure is true. It prints whether the signature was checked.
+func loadLogList(keyFileName string, insecure bool) (*certificatetransparency.LogList, error) {
+	if len(keyFileName) == 0 {
+		if !insecure {
+			return nil, errors.New("no log list key given; fetch it from " + certificatetransparency.LogListKeyURL + " and use -log-list-key, or use -insecure-unsigned-list to skip the signature check")
+		}
+		fmt.Printf("Not checking the log list signature (-insecure-unsigned-list)\n")
+		return certificatetransparency.GetAllLogsList()
+	}
+
+	pemBytes, err := ioutil.ReadFile(keyFileName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := certificatetransparency.ParseLogListKey(pemBytes)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Checking the log list signature against %s\n", keyFileName)
+	return certificatetransparency.GetSignedLogsList(key)
+}
+
+func main() {
+	codec := flag.String("codec", "", "codec for the converted file (flate, zstd or none); the default is to keep the current one")
+	keyFileName := flag.String("log-list-key", "", "PEM file containing the key that signs the log list")
+	insecure := flag.Bool("insecure-unsigned-list", false, "use the log list without checking its signature")
+	flag.Parse()
+	if flag.NArg() != 1 && flag.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-codec name] [-log-list-key <PEM file>] [-insecure-unsigned-list] <log entries file> [log URL]\n", os.Args[0])
+		os.Exit(1)
+	}
+	fileName := flag.Arg(0)
+
+	in, err := os.Open(fileName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open entries file: %s\n", err)
+		os.Exit(1)
+	}
+	oldHeader, err := certificatetransparency.EntriesFile{File: in}.Header()
+	in.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read header: %s\n", err)
+		os.Exit(1)
+	}
+
+	var log *certificatetransparency.Log
+	if flag.NArg() == 2 {
+		logs, err := loadLogList(*keyFileName, *insecure)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get log list: %s\n", err)
+			os.Exit(1)
+		}
+		data := logs.LogByURL(flag.Arg(1))
+		if data == nil {
+			fmt.Fprintf(os.Stderr, "Log %s is not in the log list\n", flag.Arg(1))
+			os.Exit(1)
+		}
+		if data.PublicLog == nil {
+			fmt.Fprintf(os.Stderr, "Log %s has an unusable public key: %s\n", flag.Arg(1), data.KeyErr)
+			os.Exit(1)
+		}
+		log = data.PublicLog
+		if !oldHeader.MatchesLog(log) {
+			fmt.Fprintf(os.Stderr, "Entries file is for a different log (%s)\n", oldHeader.LogURL)
+			os.Exit(1)
+		}
+	}
+
+	header := certificatetransparency.NewFileHeader(log)
+	if log == nil && len(oldHeader.LogID) > 0 {
+		header.LogURL = oldHeader.LogURL
+		header.LogID = oldHeader.LogID
+	}
+	switch *codec {
+	case "", oldHeader.Codec:
+		header.Codec = oldHeader.Codec
+		header.Dictionary = oldHeader.Dictionary
+	case certificatetransparency.CodecFlate, certificatetransparency.CodecZstd, certificatetransparency.CodecNone:
+		header.Codec = *codec
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown codec %s\n", *codec)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Converting %s from format version %d to %d, codec %s to %s\n", fileName, oldHeader.Version, header.Version, oldHeader.Codec, header.Codec)
+	count, err := certificatetransparency.MigrateEntriesFile(fileName, header, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to convert entries file: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Copied %d entries\n", count)
+}
@@ -5,11 +5,17 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"errors"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"sync"
 	"time"
 	"strconv"
+	"strings"
 	"path"
 	//"regexp"
 	"github.com/agl/certificatetransparency"
@@ -51,94 +57,233 @@ func displayProgress(statusChan chan certificatetransparency.OperationStatus, wg
 	}()
 }
 
+// shardDescription describes the temporal interval of a sharded log.
+func shardDescription(log certificatetransparency.LogData) string {
+	if log.TemporalStart.IsZero() && log.TemporalEnd.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf(", shard: %s to %s", log.TemporalStart.Format("2006-01-02"), log.TemporalEnd.Format("2006-01-02"))
+}
+
+// insecureUnsignedList allows a log list to be used without checking its
+// signature.
+var insecureUnsignedList = flag.Bool("insecure-unsigned-list", false, "use the log list without checking its signature")
+
 func usage(logs *certificatetransparency.LogList) {
-	fmt.Fprintf(os.Stderr, "Usage: %s <log> <log entries folder>\n", os.Args[0])
-	fmt.Fprintln(os.Stderr, "These logs are based on all_logs_list.json from https://www.certificate-transparency.org/known-logs, and may include logs that are no longer in operation")
+	fmt.Fprintf(os.Stderr, "Usage: %s [-insecure-unsigned-list] <log> <log entries folder> [log list file or URL]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "These logs are based on the v3 log list, by default from %s, and may include logs that are no longer in operation\n", certificatetransparency.LogListURL)
+	fmt.Fprintf(os.Stderr, "The log list's signature is checked against <log entries folder>/%s, which can be fetched from %s\n", logListKeyFile, certificatetransparency.LogListKeyURL)
+	if logs == nil {
+		os.Exit(2)
+	}
 	fmt.Fprintf(os.Stderr, "<log> is one of 0-%d fro mthe following dynamic list:\n", len(logs.Logs)-1)
 	for i, log := range logs.Logs {
-		fmt.Fprintf(os.Stderr, "[%d] %s (URL: https://%s, operator: %s)\n",
-			i, log.Desc, log.URL, log.OperatorName)
+		kind := ""
+		if log.PublicLog != nil && len(log.PublicLog.TileRoot) > 0 {
+			kind = ", tiled"
+		}
+		fmt.Fprintf(os.Stderr, "[%d] %s (URL: https://%s, operator: %s, state: %s%s%s)\n",
+			i, log.Desc, log.URL, log.OperatorName, log.State, shardDescription(log), kind)
 	}
 	os.Exit(2)
 }
 
-func main() {
+// logListKeyFile is the name of the file, in the log entries folder, that
+// contains the key that signs the log list. The log list must have a valid
+// signature from that key unless -insecure-unsigned-list is given.
+const logListKeyFile = "log_list_pubkey.pem"
 
+// loadLogList loads the log list named on the command line, if any, which may
+// be a URL or a local file. The signature is expected next to the list, with
+// the extension .sig, and is checked against the key in the log entries
+// folder. It prints whether the signature was checked.
+func loadLogList() (*certificatetransparency.LogList, error) {
+	source := certificatetransparency.LogListURL
+	sigSource := certificatetransparency.LogListSignatureURL
+	if flag.NArg() >= 3 {
+		source = flag.Arg(2)
+		sigSource = strings.TrimSuffix(source, ".json") + ".sig"
+	}
+	isURL := strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://")
 
-	logs, err := certificatetransparency.GetAllLogsList()
-	if err != nil {
-                fmt.Fprintf(os.Stderr, "Failed to get log list: %s\n", err)
-                os.Exit(1)
-        }
+	var key crypto.PublicKey
+	var keyFileName string
+	if flag.NArg() >= 2 {
+		keyFileName = path.Join(flag.Arg(1), logListKeyFile)
+		pemBytes, err := ioutil.ReadFile(keyFileName)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			if key, err = certificatetransparency.ParseLogListKey(pemBytes); err != nil {
+				return nil, err
+			}
+		}
+	}
 
-        if len(os.Args) != 3 {
-                usage(logs)
-        }
+	if key == nil {
+		if !*insecureUnsignedList {
+			if len(keyFileName) == 0 {
+				return nil, errors.New("no log entries folder to find the log list key in; use -insecure-unsigned-list to skip the signature check")
+			}
+			return nil, fmt.Errorf("%s not found; fetch it from %s, or use -insecure-unsigned-list to skip the signature check", keyFileName, certificatetransparency.LogListKeyURL)
+		}
+		fmt.Printf("Not checking the log list signature (-insecure-unsigned-list)\n")
+		if isURL {
+			return certificatetransparency.LoadLogListURL(context.Background(), nil, source)
+		}
+		return certificatetransparency.LoadLogListFile(source)
+	}
 
+	fmt.Printf("Checking the log list signature against %s\n", keyFileName)
+	if isURL {
+		return certificatetransparency.LoadSignedLogListURL(context.Background(), nil, source, sigSource, key)
+	}
+	return certificatetransparency.LoadSignedLogListFile(source, sigSource, key)
+}
+
+func main() {
+	flag.Parse()
 
-	logNum, err := strconv.Atoi(os.Args[1])
+	logs, err := loadLogList()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s could no be converted to int", os.Args[1])
+		fmt.Fprintf(os.Stderr, "Failed to get log list: %s\n", err)
+		if flag.NArg() < 2 {
+			usage(nil)
+		}
+		os.Exit(1)
+	}
+
+	if flag.NArg() != 2 && flag.NArg() != 3 {
 		usage(logs)
 	}
 
-	if logNum >= len(logs.Logs) {
-                fmt.Fprintf(os.Stderr, "%d is not a valid log number", os.Args[1])
-                usage(logs)
-        }
+	logNum, err := strconv.Atoi(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s could no be converted to int", flag.Arg(0))
+		usage(logs)
+	}
+
+	if logNum < 0 || logNum >= len(logs.Logs) {
+		fmt.Fprintf(os.Stderr, "%s is not a valid log number", flag.Arg(0))
+		usage(logs)
+	}
 
-        folder := os.Args[2]
+	if logs.Logs[logNum].State == certificatetransparency.LogStateRejected {
+		fmt.Fprintf(os.Stderr, "Log %d was rejected and is not worth syncing\n", logNum)
+		os.Exit(1)
+	}
+
+	log := logs.Logs[logNum].PublicLog
+	if log == nil {
+		fmt.Fprintf(os.Stderr, "Log %d has an unusable public key: %s\n", logNum, logs.Logs[logNum].KeyErr)
+		os.Exit(1)
+	}
+
+	folder := flag.Arg(1)
 	fileName := path.Join(folder, logs.Logs[logNum].SafeFileName)
 
-	fmt.Printf("Selected log: %s (https://%s)\n", logs.Logs[logNum].Desc, logs.Logs[logNum].URL)
+	fmt.Printf("Selected log: %s (https://%s, state: %s since %s%s)\n", logs.Logs[logNum].Desc, logs.Logs[logNum].URL,
+		logs.Logs[logNum].State, logs.Logs[logNum].StateTime.Format("2006-01-02"), shardDescription(logs.Logs[logNum]))
 	fmt.Printf("Path to entries file: %s\n", fileName)
 
-	out, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0666)
+	fmt.Printf("Counting existing entries... ")
+	entriesFile, count, err := certificatetransparency.OpenEntriesFile(fileName, certificatetransparency.NewFileHeader(log))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to open entries file: %s\n", err)
+		fmt.Fprintf(os.Stderr, "\nFailed to open entries file: %s\n", err)
 		os.Exit(1)
 	}
-	defer out.Close()
+	defer entriesFile.Close()
+	fmt.Printf("%d\n", count)
 
-	entriesFile := certificatetransparency.EntriesFile{out}
-	fmt.Printf("Counting existing entries... ")
-	count, err := entriesFile.Count()
+	header, err := entriesFile.Header()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "\nFailed to read entries file: %s\n", err)
+		fmt.Fprintf(os.Stderr, "Failed to read entries file header: %s\n", err)
 		os.Exit(1)
 	}
-	fmt.Printf("%d\n", count)
+	if header.Version == 0 {
+		fmt.Printf("Entries file has no header, consider converting it with ct-migrate\n")
+	}
+
+	rangeFileName := certificatetransparency.CompactRangeFileName(fileName)
+	compactRange, err := certificatetransparency.ReadCompactRange(rangeFileName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read compact range: %s\n", err)
+		os.Exit(1)
+	}
+	if compactRange.Size > count {
+		fmt.Printf("Compact range covers more entries than the file, rehashing from the start\n")
+		compactRange = new(certificatetransparency.CompactRange)
+	}
+
+	configFileName := certificatetransparency.LogConfigFileName(fileName)
+	config, err := certificatetransparency.ReadLogConfig(configFileName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read log config: %s\n", err)
+		os.Exit(1)
+	}
+	if err := config.Apply(log); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to configure HTTP client: %s\n", err)
+		os.Exit(1)
+	}
+	ctx := context.Background()
 
 	fmt.Printf("Fetching signed tree head... \n")
-	sth, err := logs.Logs[logNum].PublicLog.GetSignedTreeHead()
+	sth, err := log.GetSignedTreeHead(ctx)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
 	fmt.Printf("%d total entries at %s\n", sth.Size, sth.Time.Format(time.ANSIC))
+
+	sthStore, err := certificatetransparency.OpenSTHStore(certificatetransparency.STHStoreFileName(fileName))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read stored tree heads: %s\n", err)
+		os.Exit(1)
+	}
+	if err := sthStore.Add(ctx, log, sth); err != nil {
+		fmt.Fprintf(os.Stderr, "Rejecting signed tree head: %s\n", err)
+		os.Exit(1)
+	}
 	if count == sth.Size {
 		fmt.Printf("Nothing to do\n")
 		return
 	}
 
+	out, err := entriesFile.NewAppender()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to append to entries file: %s\n", err)
+		os.Exit(1)
+	}
+
 	statusChan := make(chan certificatetransparency.OperationStatus, 1)
 	wg := new(sync.WaitGroup)
 	displayProgress(statusChan, wg)
-	_, err = logs.Logs[logNum].PublicLog.DownloadRange(out, statusChan, count, sth.Size)
+	_, err = log.DownloadRange(ctx, out, statusChan, count, sth.Size)
 	wg.Wait()
 
 	clearLine()
+	if batchSize := log.CurrentBatchSize(); batchSize != config.BatchSize {
+		config.BatchSize = batchSize
+		if err := config.WriteFile(configFileName); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to save log config: %s\n", err)
+		}
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error while downloading: %s\n", err)
 		os.Exit(1)
 	}
+	if _, err := entriesFile.UpdateIndex(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to index new entries: %s\n", err)
+		os.Exit(1)
+	}
 
-	fmt.Printf("Hashing tree\n")
+	fmt.Printf("Hashing new entries\n")
 	entriesFile.Seek(0, 0)
 	statusChan = make(chan certificatetransparency.OperationStatus, 1)
 	wg = new(sync.WaitGroup)
 	displayProgress(statusChan, wg)
-	treeHash, err := entriesFile.HashTree(statusChan, sth.Size)
+	err = entriesFile.ExtendRange(statusChan, compactRange, sth.Size)
 	wg.Wait()
 
 	clearLine()
@@ -146,9 +291,14 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Error hashing tree: %s\n", err)
 		os.Exit(1)
 	}
+	treeHash := compactRange.Root()
 	if !bytes.Equal(treeHash[:], sth.Hash) {
 		fmt.Fprintf(os.Stderr, "Hashes do not match! Calculated: %x, STH contains %x\n", treeHash, sth.Hash)
 		os.Exit(1)
 	}
+	if err := compactRange.WriteFile(rangeFileName); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write compact range: %s\n", err)
+		os.Exit(1)
+	}
 
 }
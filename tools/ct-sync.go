@@ -5,6 +5,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"sync"
@@ -55,53 +56,105 @@ func main() {
 		os.Exit(1)
 	}
 	fileName := os.Args[1]
+	log := certificatetransparency.PilotLog
 
-	out, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0666)
+	fmt.Printf("Counting existing entries... ")
+	entriesFile, count, err := certificatetransparency.OpenEntriesFile(fileName, certificatetransparency.NewFileHeader(log))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to open entries file: %s\n", err)
+		fmt.Fprintf(os.Stderr, "\nFailed to open entries file: %s\n", err)
 		os.Exit(1)
 	}
-	defer out.Close()
+	defer entriesFile.Close()
+	fmt.Printf("%d\n", count)
 
-	entriesFile := certificatetransparency.EntriesFile{out}
-	fmt.Printf("Counting existing entries... ")
-	count, err := entriesFile.Count()
+	header, err := entriesFile.Header()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "\nFailed to read entries file: %s\n", err)
+		fmt.Fprintf(os.Stderr, "Failed to read entries file header: %s\n", err)
 		os.Exit(1)
 	}
-	fmt.Printf("%d\n", count)
+	if header.Version == 0 {
+		fmt.Printf("Entries file has no header, consider converting it with ct-migrate\n")
+	}
+
+	rangeFileName := certificatetransparency.CompactRangeFileName(fileName)
+	compactRange, err := certificatetransparency.ReadCompactRange(rangeFileName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read compact range: %s\n", err)
+		os.Exit(1)
+	}
+	if compactRange.Size > count {
+		fmt.Printf("Compact range covers more entries than the file, rehashing from the start\n")
+		compactRange = new(certificatetransparency.CompactRange)
+	}
+
+	configFileName := certificatetransparency.LogConfigFileName(fileName)
+	config, err := certificatetransparency.ReadLogConfig(configFileName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read log config: %s\n", err)
+		os.Exit(1)
+	}
+	if err := config.Apply(log); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to configure HTTP client: %s\n", err)
+		os.Exit(1)
+	}
+	ctx := context.Background()
 
 	fmt.Printf("Fetching signed tree head... ")
-	sth, err := certificatetransparency.PilotLog.GetSignedTreeHead()
+	sth, err := log.GetSignedTreeHead(ctx)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
 	fmt.Printf("%d total entries at %s\n", sth.Size, sth.Time.Format(time.ANSIC))
+
+	sthStore, err := certificatetransparency.OpenSTHStore(certificatetransparency.STHStoreFileName(fileName))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read stored tree heads: %s\n", err)
+		os.Exit(1)
+	}
+	if err := sthStore.Add(ctx, log, sth); err != nil {
+		fmt.Fprintf(os.Stderr, "Rejecting signed tree head: %s\n", err)
+		os.Exit(1)
+	}
 	if count == sth.Size {
 		fmt.Printf("Nothing to do\n")
 		return
 	}
 
+	out, err := entriesFile.NewAppender()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to append to entries file: %s\n", err)
+		os.Exit(1)
+	}
+
 	statusChan := make(chan certificatetransparency.OperationStatus, 1)
 	wg := new(sync.WaitGroup)
 	displayProgress(statusChan, wg)
-	_, err = certificatetransparency.PilotLog.DownloadRange(out, statusChan, count, sth.Size)
+	_, err = log.DownloadRange(ctx, out, statusChan, count, sth.Size)
 	wg.Wait()
 
 	clearLine()
+	if batchSize := log.CurrentBatchSize(); batchSize != config.BatchSize {
+		config.BatchSize = batchSize
+		if err := config.WriteFile(configFileName); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to save log config: %s\n", err)
+		}
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error while downloading: %s\n", err)
 		os.Exit(1)
 	}
+	if _, err := entriesFile.UpdateIndex(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to index new entries: %s\n", err)
+		os.Exit(1)
+	}
 
-	fmt.Printf("Hashing tree\n")
+	fmt.Printf("Hashing new entries\n")
 	entriesFile.Seek(0, 0)
 	statusChan = make(chan certificatetransparency.OperationStatus, 1)
 	wg = new(sync.WaitGroup)
 	displayProgress(statusChan, wg)
-	treeHash, err := entriesFile.HashTree(statusChan, sth.Size)
+	err = entriesFile.ExtendRange(statusChan, compactRange, sth.Size)
 	wg.Wait()
 
 	clearLine()
@@ -109,8 +162,13 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Error hashing tree: %s\n", err)
 		os.Exit(1)
 	}
+	treeHash := compactRange.Root()
 	if !bytes.Equal(treeHash[:], sth.Hash) {
 		fmt.Fprintf(os.Stderr, "Hashes do not match! Calculated: %x, STH contains %x\n", treeHash, sth.Hash)
 		os.Exit(1)
 	}
+	if err := compactRange.WriteFile(rangeFileName); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write compact range: %s\n", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,64 @@
+// This utility program checks a log entries file for corruption. It prints
+// each corrupt record and then the ranges of entries that need to be fetched
+// from the log again.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/agl/certificatetransparency"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: %s <log entries file>\n", os.Args[0])
+		os.Exit(1)
+	}
+	fileName := os.Args[1]
+
+	in, err := os.Open(fileName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open entries file: %s\n", err)
+		os.Exit(1)
+	}
+	defer in.Close()
+
+	entriesFile := certificatetransparency.EntriesFile{File: in}
+	header, err := entriesFile.Header()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read header: %s\n", err)
+		os.Exit(1)
+	}
+	if len(header.Checksum) == 0 {
+		fmt.Printf("File has no record checksums, checking that entries parse\n")
+	}
+
+	corrupt, err := entriesFile.Verify(nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read entries file: %s\n", err)
+		os.Exit(1)
+	}
+	if len(corrupt) == 0 {
+		fmt.Printf("No corrupt records\n")
+		return
+	}
+
+	for _, err := range corrupt {
+		fmt.Printf("%s\n", err)
+	}
+
+	fmt.Printf("Damaged entry ranges:\n")
+	start, end := corrupt[0].Index, corrupt[0].Index
+	for _, err := range corrupt[1:] {
+		if err.Index == end+1 {
+			end = err.Index
+			continue
+		}
+		fmt.Printf("%d-%d\n", start, end)
+		start, end = err.Index, err.Index
+	}
+	fmt.Printf("%d-%d\n", start, end)
+	os.Exit(1)
+}
@@ -0,0 +1,126 @@
+// This utility program checks the SCTs embedded in a certificate. It reads a
+// PEM file containing the certificate followed by its issuer and verifies
+// each SCT against the log that issued it. The log keys come from the log
+// list, whose signature is checked against the key given with -log-list-key.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/agl/certificatetransparency"
+)
+
+// loadLogList fetches the log list and checks its signature against the key in
+// keyFileName. If keyFileName is empty then the signature is only skipped if
+// insecure is true. It prints whether the signature was checked.
+func loadLogList(keyFileName string, insecure bool) (*certificatetransparency.LogList, error) {
+	if len(keyFileName) == 0 {
+		if !insecure {
+			return nil, errors.New("no log list key given; fetch it from " + certificatetransparency.LogListKeyURL + " and use -log-list-key, or use -insecure-unsigned-list to skip the signature check")
+		}
+		fmt.Printf("Not checking the log list signature (-insecure-unsigned-list)\n")
+		return certificatetransparency.GetAllLogsList()
+	}
+
+	pemBytes, err := ioutil.ReadFile(keyFileName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := certificatetransparency.ParseLogListKey(pemBytes)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Checking the log list signature against %s\n", keyFileName)
+	return certificatetransparency.GetSignedLogsList(key)
+}
+
+func main() {
+	keyFileName := flag.String("log-list-key", "", "PEM file containing the key that signs the log list")
+	insecure := flag.Bool("insecure-unsigned-list", false, "use the log list without checking its signature")
+	flag.Parse()
+	if flag.NArg() != 1 && flag.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-log-list-key <PEM file>] [-insecure-unsigned-list] <PEM file> [log entries folder]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "The PEM file must contain the certificate followed by its issuer. If a log entries folder is given, the output says whether each log is mirrored there.\n")
+		os.Exit(1)
+	}
+
+	pemBytes, err := ioutil.ReadFile(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read PEM file: %s\n", err)
+		os.Exit(1)
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, pemBytes = pem.Decode(pemBytes)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to parse certificate: %s\n", err)
+			os.Exit(1)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) < 2 {
+		fmt.Fprintf(os.Stderr, "Need a certificate and its issuer, found %d certificates\n", len(certs))
+		os.Exit(1)
+	}
+
+	logs, err := loadLogList(*keyFileName, *insecure)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get log list: %s\n", err)
+		os.Exit(1)
+	}
+
+	statuses, err := logs.CheckEmbeddedSCTs(certs[0], certs[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to extract SCTs: %s\n", err)
+		os.Exit(1)
+	}
+	if len(statuses) == 0 {
+		fmt.Printf("No embedded SCTs\n")
+		return
+	}
+
+	failed := false
+	for _, status := range statuses {
+		logName := "unknown log " + status.SCT.LogID.String()
+		mirrored := ""
+		if status.Log != nil {
+			logName = fmt.Sprintf("%s (https://%s)", status.Log.Desc, status.Log.URL)
+			if flag.NArg() == 2 {
+				if _, err := os.Stat(path.Join(flag.Arg(1), status.Log.SafeFileName)); err == nil {
+					mirrored = ", mirrored"
+				} else {
+					mirrored = ", not mirrored"
+				}
+			}
+		}
+
+		result := "OK"
+		if status.Err != nil {
+			result = status.Err.Error()
+			failed = true
+		}
+		fmt.Printf("%s: %s%s: %s\n", status.SCT.Time.UTC().Format(time.RFC3339), logName, mirrored, result)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
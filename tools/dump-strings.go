@@ -3,7 +3,6 @@
 package main
 
 import (
-	"crypto/x509"
 	"fmt"
 	"os"
 	"sync"
@@ -42,12 +41,13 @@ func main() {
 
 	outputLock := new(sync.Mutex)
 
-	entriesFile.Map(func(ent *certificatetransparency.EntryAndPosition, err error) {
+	err = entriesFile.Map(func(ent *certificatetransparency.EntryAndPosition, err error) {
 		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
 			return
 		}
 
-		cert, err := x509.ParseCertificate(ent.Entry.X509Cert)
+		cert, err := ent.Entry.Certificate()
 		if err != nil {
 			return
 		}
@@ -89,4 +89,8 @@ func main() {
 		fmt.Print(output)
 		outputLock.Unlock()
 	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read entries file: %s\n", err)
+		os.Exit(1)
+	}
 }